@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Record a moderation action performed by a client, or by the server when the client is nil.
+// Actions are only recorded for founded channels, the audit log of a channel is deleted when it is dropped.
+func (s *Server) audit(c *Client, channel string, action string, target string, reason string) {
+	if channel != CHANNEL_SERVER {
+		dbch, err := s.store.Channel(channel)
+		if err != nil {
+			log.Panicf("%+v", err)
+		} else if dbch.Channel == "" {
+			return
+		}
+	}
+
+	var account int64
+	if c != nil {
+		account = c.account
+	}
+
+	err := s.store.AddAudit(DBAudit{Channel: channel, Account: account, Action: action, Target: target, Reason: reason, Time: time.Now().Unix()})
+	if err != nil {
+		log.Panicf("%+v", err)
+	}
+}
+
+func (a *DBAudit) Print(channel string, actor string) string {
+	target := ""
+	if a.Target != "" {
+		target = " " + a.Target
+	}
+
+	return strings.TrimSpace(fmt.Sprintf("%s %s %6s%s by %s %s", time.Unix(a.Time, 0).Format(time.Stamp), channel, a.Action, target, actor, a.Reason))
+}
+
+func (s *Server) revealAuditLog(channel string, client string, page int) {
+	cl := s.getClient(client)
+	if cl == nil {
+		return
+	}
+
+	offset := 0
+	limit := -1
+	if page > 0 {
+		offset = CHANNEL_LOGS_PER_PAGE * (page - 1)
+		limit = CHANNEL_LOGS_PER_PAGE + 1 // Fetch an additional entry to determine whether entries remain
+	}
+
+	entries, err := s.store.Audit(channel, offset, limit)
+	if err != nil {
+		log.Panicf("%+v", err)
+	}
+
+	logsRemain := false
+	if page > 0 && len(entries) > CHANNEL_LOGS_PER_PAGE {
+		entries = entries[:CHANNEL_LOGS_PER_PAGE]
+		logsRemain = true
+	}
+
+	if len(entries) == 0 {
+		cl.sendMessage("No audit entries match criteria")
+		return
+	}
+
+	filterType := "all entries"
+	if page > -1 {
+		filterType = fmt.Sprintf("page %d", page)
+	}
+	cl.sendMessage(fmt.Sprintf("Auditing %s (%s)", channel, filterType))
+
+	for _, a := range entries {
+		cl.sendMessage(a.Print(channel, s.actorToken(channel, a.Account)))
+	}
+
+	finishedMessage := fmt.Sprintf("Finished auditing %s", channel)
+	if logsRemain {
+		finishedMessage = fmt.Sprintf("Additional audit entries on page %d", page+1)
+	}
+	cl.sendMessage(finishedMessage)
+}
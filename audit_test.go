@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAudit(t *testing.T) {
+	s := newTestServer(t)
+	require.NoError(t, s.store.AddChannel(1, &DBChannel{Channel: "#founded"}))
+
+	c := connectTestClient(t, s, "test")
+	defer c.Close()
+
+	// Actions in channels which are not founded are not recorded
+	c.send("JOIN #open", "TOPIC #open :Unfounded", "PING :topic")
+	c.expect("PONG AnonIRC topic")
+
+	entries, err := s.store.Audit("#open", 0, -1)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	c.send("IDENTIFY admin password")
+	c.expect("Identified successfully")
+	c.send("JOIN #founded", "TOPIC #founded :Founded", "PING :topic")
+	c.expect("PONG AnonIRC topic")
+
+	entries, err = s.store.Audit("#founded", 0, -1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "Founded", entries[0].Reason)
+
+	// Dropping a channel deletes its audit log, the drop is recorded in the server audit log
+	c.send("DROP #founded #founded")
+	c.expect("Dropped #founded")
+
+	entries, err = s.store.Audit("#founded", 0, -1)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	entries, err = s.store.Audit(CHANNEL_SERVER, 0, -1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, COMMAND_DROP, entries[0].Action)
+	assert.Equal(t, "#founded", entries[0].Target)
+}
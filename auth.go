@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DEFAULT_AUTH_ATTEMPTS      = 3
+	DEFAULT_AUTH_LOCKOUT       = 30
+	DEFAULT_AUTH_MAX_LOCKOUT   = 3600
+	DEFAULT_AUTH_BAN_THRESHOLD = 20
+	DEFAULT_AUTH_BAN_DURATION  = 86400
+)
+
+// Failed attempts are forgotten after this amount of time without further failures
+const AUTH_FAILURE_EXPIRY = 24 * time.Hour
+
+var ErrAuthLocked = errors.New("too many failed attempts, try again later")
+
+type AuthFailure struct {
+	attempts int
+	last     time.Time
+	locked   time.Time
+}
+
+// AuthLimiter tracks failed authentication attempts per account and per address
+type AuthLimiter struct {
+	failures map[string]*AuthFailure
+
+	sync.Mutex
+}
+
+func NewAuthLimiter() *AuthLimiter {
+	return &AuthLimiter{failures: make(map[string]*AuthFailure)}
+}
+
+func authAccountKey(accountid int64) string {
+	return fmt.Sprintf("account %d", accountid)
+}
+
+func authAddressKey(iphash string) string {
+	return "address " + iphash
+}
+
+// Amount of time remaining until any of the specified keys may authenticate again
+func (a *AuthLimiter) lockedFor(keys ...string) time.Duration {
+	a.Lock()
+	defer a.Unlock()
+
+	var remaining time.Duration
+	for _, key := range keys {
+		if f, ok := a.failures[key]; ok {
+			if r := time.Until(f.locked); r > remaining {
+				remaining = r
+			}
+		}
+	}
+
+	return remaining
+}
+
+// Record a failed attempt, locking the key with an exponential backoff once the permitted attempts are exceeded
+func (a *AuthLimiter) fail(key string, attempts int, lockout int, maxlockout int) int {
+	a.Lock()
+	defer a.Unlock()
+
+	now := time.Now()
+	for k, f := range a.failures {
+		if now.Sub(f.last) > AUTH_FAILURE_EXPIRY && now.After(f.locked) {
+			delete(a.failures, k)
+		}
+	}
+
+	f, ok := a.failures[key]
+	if !ok {
+		f = &AuthFailure{}
+		a.failures[key] = f
+	}
+	f.attempts++
+	f.last = now
+
+	if f.attempts >= attempts {
+		d := float64(lockout) * math.Pow(2, float64(f.attempts-attempts))
+		if d > float64(maxlockout) {
+			d = float64(maxlockout)
+		}
+		f.locked = now.Add(time.Duration(d) * time.Second)
+	}
+
+	return f.attempts
+}
+
+func (a *AuthLimiter) reset(key string) {
+	a.Lock()
+	defer a.Unlock()
+
+	delete(a.failures, key)
+}
+
+// Currently locked keys, sorted by remaining lockout
+func (a *AuthLimiter) lockouts() []string {
+	a.Lock()
+	defer a.Unlock()
+
+	type lockout struct {
+		key       string
+		attempts  int
+		remaining time.Duration
+	}
+
+	var locked []lockout
+	for key, f := range a.failures {
+		if r := time.Until(f.locked); r > 0 {
+			locked = append(locked, lockout{key, f.attempts, r})
+		}
+	}
+	sort.Slice(locked, func(i, j int) bool {
+		return locked[i].remaining > locked[j].remaining
+	})
+
+	var ls []string
+	for _, l := range locked {
+		ls = append(ls, fmt.Sprintf("%s locked for %s after %d failed attempts", l.key, l.remaining.Round(time.Second), l.attempts))
+	}
+	return ls
+}
+
+// Verify a username and password, enforcing lockouts after repeated failures
+func (s *Server) authenticate(c *Client, username string, password string) (int64, error) {
+	account, err := s.store.AccountU(username)
+	if err != nil {
+		return 0, err
+	}
+
+	keys := []string{authAddressKey(c.iphash)}
+	if account.ID > 0 {
+		keys = append(keys, authAccountKey(account.ID))
+	}
+
+	if s.auth.lockedFor(keys...) > 0 {
+		return 0, ErrAuthLocked
+	}
+
+	accountid, err := s.store.Auth(username, password)
+	if err != nil {
+		return 0, err
+	} else if accountid > 0 {
+		for _, key := range keys[1:] {
+			s.auth.reset(key)
+		}
+		return accountid, nil
+	}
+
+	var addressattempts int
+	for _, key := range keys {
+		attempts := s.auth.fail(key, s.config.AuthAttempts, s.config.AuthLockout, s.config.AuthMaxLockout)
+		if key == keys[0] {
+			addressattempts = attempts
+		}
+	}
+
+	if s.config.AuthBanThreshold > 0 && addressattempts >= s.config.AuthBanThreshold {
+		s.auth.reset(keys[0])
+		s.banAuthFailures(c)
+	}
+
+	return 0, nil
+}
+
+// Identify a client to an account, returning false when the username or password is incorrect
+func (s *Server) identify(c *Client, username string, password string) (bool, error) {
+	accountid, err := s.authenticate(c, username, password)
+	if err != nil {
+		if err != ErrAuthLocked {
+			log.Panicf("%+v", err)
+		}
+		return false, err
+	} else if accountid == 0 {
+		return false, nil
+	}
+
+	c.account = accountid
+	return true, nil
+}
+
+func (s *Server) banAuthFailures(c *Client) {
+	reason := "Too many failed authentication attempts"
+	log.Printf("Banning %s: %s", c.iphash, reason)
+
+	err := s.ban(CHANNEL_SERVER, c.iphash, 0, 0, time.Now().Unix()+int64(s.config.AuthBanDuration), reason)
+	if err != nil {
+		log.Panicf("%+v", err)
+	}
+
+	s.audit(nil, CHANNEL_SERVER, COMMAND_BAN, "", reason)
+}
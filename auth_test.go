@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthLimiter(t *testing.T) {
+	a := NewAuthLimiter()
+	key := authAccountKey(1)
+
+	for i := 1; i < 3; i++ {
+		assert.Equal(t, i, a.fail(key, 3, 30, 3600))
+		assert.Equal(t, time.Duration(0), a.lockedFor(key))
+	}
+
+	// Lockout doubles with each additional failure
+	a.fail(key, 3, 30, 3600)
+	assert.InDelta(t, 30*time.Second, a.lockedFor(key), float64(time.Second))
+	a.fail(key, 3, 30, 3600)
+	assert.InDelta(t, 60*time.Second, a.lockedFor(key), float64(time.Second))
+	assert.Len(t, a.lockouts(), 1)
+
+	for i := 0; i < 10; i++ {
+		a.fail(key, 3, 30, 3600)
+	}
+	assert.InDelta(t, 3600*time.Second, a.lockedFor(key), float64(time.Second))
+	assert.Equal(t, time.Duration(0), a.lockedFor(authAddressKey("address")))
+
+	a.reset(key)
+	assert.Equal(t, time.Duration(0), a.lockedFor(key))
+	assert.Len(t, a.lockouts(), 0)
+}
+
+func TestRegister(t *testing.T) {
+	s := newTestServer(t)
+	s.config.FloodCommandBurst = 20
+
+	c := connectTestClient(t, s, "test")
+	defer c.Close()
+
+	c.send("REGISTER username password")
+	c.expect("REGISTER <username> <password> <confirm password>")
+	c.send("REGISTER user-name password password")
+	c.expect("Unable to register, usernames may only contain up to")
+	c.send("REGISTER username password other")
+	c.expect("Unable to register, passwords don't match")
+	c.send("REGISTER admin password password")
+	c.expect("Unable to register, an account with that username already exists")
+
+	// Clients are identified once registered
+	c.send("REGISTER username password password")
+	c.expect("Registered successfully")
+	c.send("REGISTER other password password")
+	c.expect("Unable to register, you are already identified")
+
+	a, err := s.store.AccountU("username")
+	require.NoError(t, err)
+	assert.NotZero(t, a.ID)
+	a, err = s.store.AccountU("other")
+	require.NoError(t, err)
+	assert.Zero(t, a.ID)
+}
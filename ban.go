@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// Interval at which expired bans are deleted
+const BAN_SWEEP_INTERVAL = 10 * time.Minute
+
+var banTypeLabels = map[int]string{
+	BAN_TYPE_ADDRESS: "Address",
+	BAN_TYPE_ACCOUNT: "Account",
+}
+
+// Opaque identifier of a ban target, account targets match the identifiers listed by GRANT
+func (s *Server) banToken(channel string, b DBBan) string {
+	if b.Type == BAN_TYPE_ACCOUNT {
+		if accountid, err := strconv.ParseInt(b.Target, 10, 64); err == nil {
+			return s.permissionToken(channel, accountid)
+		}
+	}
+
+	return s.opaqueToken(foldChannel(channel) + "-" + b.Target)
+}
+
+func (b *DBBan) Print(channel string, token string, creator string) string {
+	expires := "never"
+	if b.Expires > 0 {
+		expires = time.Unix(b.Expires, 0).Format(time.Stamp)
+	}
+
+	return strings.TrimSpace(fmt.Sprintf("%d %s %s %s %s expires %s by %s %s", b.ID, time.Unix(b.Created, 0).Format(time.Stamp), channel, banTypeLabels[b.Type], token, expires, creator, b.Reason))
+}
+
+func (s *Server) listBans(channel string, client string, page int) {
+	cl := s.getClient(client)
+	if cl == nil {
+		return
+	}
+
+	offset := 0
+	limit := -1
+	if page > 0 {
+		offset = CHANNEL_LOGS_PER_PAGE * (page - 1)
+		limit = CHANNEL_LOGS_PER_PAGE + 1 // Fetch an additional ban to determine whether bans remain
+	}
+
+	bans, err := s.store.Bans(channel, offset, limit)
+	if err != nil {
+		log.Panicf("%+v", err)
+	}
+
+	bansRemain := false
+	if page > 0 && len(bans) > CHANNEL_LOGS_PER_PAGE {
+		bans = bans[:CHANNEL_LOGS_PER_PAGE]
+		bansRemain = true
+	}
+
+	if len(bans) == 0 {
+		cl.sendMessage("No bans match criteria")
+		return
+	}
+
+	filterType := "all bans"
+	if page > -1 {
+		filterType = fmt.Sprintf("page %d", page)
+	}
+	cl.sendMessage(fmt.Sprintf("Listing bans of %s (%s)", channel, filterType))
+
+	for _, b := range bans {
+		cl.sendMessage(b.Print(channel, s.banToken(channel, b), s.actorToken(channel, b.Creator)))
+	}
+
+	finishedMessage := fmt.Sprintf("Finished listing bans of %s", channel)
+	if bansRemain {
+		finishedMessage = fmt.Sprintf("Additional bans on page %d", page+1)
+	}
+	cl.sendMessage(finishedMessage)
+}
+
+// Reply to a MODE +b query, bans are only listed to clients permitted to use BANS
+func (s *Server) sendBanList(c *Client, channel string) {
+	if validChannel(channel) && c.canUse(COMMAND_BANS, channel) {
+		bans, err := s.store.Bans(channel, 0, -1)
+		if err != nil {
+			log.Panicf("%+v", err)
+		}
+
+		for _, b := range bans {
+			c.writeMessage(irc.RPL_BANLIST, []string{channel, "*!*@" + s.banToken(channel, b), prefixAnonIRC.Name, strconv.FormatInt(b.Created, 10)})
+		}
+	}
+
+	c.writeMessage(irc.RPL_ENDOFBANLIST, []string{channel, "End of Channel Ban List"})
+}
+
+func (s *Server) sweepBans() {
+	for {
+		deleted, err := s.store.DeleteExpiredBans()
+		if err != nil {
+			log.Printf("%+v", err)
+		} else if deleted > 0 && debugMode {
+			log.Printf("Deleted %d expired bans", deleted)
+		}
+
+		time.Sleep(BAN_SWEEP_INTERVAL)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnban(t *testing.T) {
+	s := newTestServer(t)
+	require.NoError(t, s.store.AddBan(DBBan{Channel: "#unban", Type: BAN_TYPE_ADDRESS, Target: "address", Created: time.Now().Unix()}))
+
+	bans, err := s.store.Bans("#unban", 0, -1)
+	require.NoError(t, err)
+	require.Len(t, bans, 1)
+
+	c := connectTestClient(t, s, "test")
+	defer c.Close()
+
+	c.send("IDENTIFY admin password")
+	c.expect("Identified successfully")
+
+	// Ban IDs which can't be parsed are rejected
+	for _, banid := range []string{"99999999999999999999", "-1", "ban"} {
+		c.send("UNBAN #unban " + banid)
+		c.expect("Unable to unban, invalid ban id specified")
+	}
+
+	c.send("UNBAN #unban 2")
+	c.expect("Unable to unban, invalid ban id specified")
+
+	c.send("UNBAN #unban 1")
+	c.expect("Unbanned #unban 1")
+
+	bans, err = s.store.Bans("#unban", 0, -1)
+	require.NoError(t, err)
+	assert.Empty(t, bans)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	CAP_MESSAGE_TAGS      = "message-tags"
+	CAP_SASL              = "sasl"
+	CAP_SERVER_TIME       = "server-time"
+	CAP_USERHOST_IN_NAMES = "userhost-in-names"
+)
+
+const ERR_INVALIDCAPCMD = "410"
+
+const SERVER_TIME_FORMAT = "2006-01-02T15:04:05.000Z"
+
+// Maximum length of the capability list sent in a single CAP LS line
+const CAP_LS_LINE_LENGTH = 400
+
+// Capabilities supported by the server and the value advertised for each one
+// to clients requesting CAP LS 302
+var capabilities = map[string]string{
+	CAP_MESSAGE_TAGS:      "",
+	CAP_SASL:              strings.Join(saslMechanisms, ","),
+	CAP_SERVER_TIME:       "",
+	CAP_USERHOST_IN_NAMES: "",
+}
+
+func supportedCapability(capability string) bool {
+	_, ok := capabilities[capability]
+	return ok
+}
+
+func listCapabilities(version int) []string {
+	var caps []string
+	for capability, value := range capabilities {
+		if version >= 302 && value != "" {
+			capability += "=" + value
+		}
+		caps = append(caps, capability)
+	}
+	sort.Strings(caps)
+
+	return caps
+}
+
+func (s *Server) handleCap(c *Client, params []string) {
+	if len(params) == 0 || len(params[0]) == 0 {
+		c.writeMessage(ERR_INVALIDCAPCMD, []string{"*", "Invalid CAP command"})
+		return
+	}
+
+	subcommand := strings.ToUpper(params[0])
+	switch subcommand {
+	case irc.CAP_LS:
+		if !c.welcomed {
+			c.negotiating = true
+		}
+
+		if len(params) > 1 {
+			version, err := strconv.Atoi(params[1])
+			if err == nil && version > c.capVersion {
+				c.capVersion = version
+			}
+		}
+
+		s.sendCapList(c, irc.CAP_LS, listCapabilities(c.capVersion))
+	case irc.CAP_LIST:
+		s.sendCapList(c, irc.CAP_LIST, c.getCapabilities())
+	case irc.CAP_REQ:
+		if !c.welcomed {
+			c.negotiating = true
+		}
+
+		requested := ""
+		if len(params) > 1 {
+			requested = strings.TrimSpace(params[len(params)-1])
+		}
+
+		caps := strings.Fields(requested)
+		if len(caps) == 0 {
+			c.writeMessage(irc.CAP, []string{irc.CAP_NAK, requested})
+			return
+		}
+
+		// Requests are applied atomically, any unsupported capability rejects the entire request
+		for _, capability := range caps {
+			if !supportedCapability(strings.TrimPrefix(capability, "-")) {
+				c.writeMessage(irc.CAP, []string{irc.CAP_NAK, requested})
+				return
+			}
+		}
+
+		for _, capability := range caps {
+			if capability[0] == '-' {
+				c.disableCapability(capability[1:])
+			} else {
+				c.enableCapability(capability)
+			}
+		}
+		c.writeMessage(irc.CAP, []string{irc.CAP_ACK, requested})
+	case irc.CAP_END:
+		if c.welcomed {
+			return
+		}
+
+		c.negotiating = false
+		s.welcomeClient(c)
+	default:
+		c.writeMessage(ERR_INVALIDCAPCMD, []string{params[0], "Invalid CAP command"})
+	}
+}
+
+// Send a list of capabilities, split across multiple lines when the client supports CAP LS 302
+func (s *Server) sendCapList(c *Client, subcommand string, caps []string) {
+	if c.capVersion < 302 {
+		c.writeMessage(irc.CAP, []string{subcommand, strings.Join(caps, " ")})
+		return
+	}
+
+	var line []string
+	linelength := 0
+	for _, capability := range caps {
+		if len(line) > 0 && linelength+len(capability)+1 > CAP_LS_LINE_LENGTH {
+			c.writeMessage(irc.CAP, []string{subcommand, "*", strings.Join(line, " ")})
+
+			line = nil
+			linelength = 0
+		}
+
+		line = append(line, capability)
+		linelength += len(capability) + 1
+	}
+
+	c.writeMessage(irc.CAP, []string{subcommand, strings.Join(line, " ")})
+}
+
+// Build the tags sent along with a message, based on the capabilities enabled by the client
+func (s *Server) messageTags(c *Client, msg *ClientMessage) string {
+	var tags []string
+	if c.hasCapability(CAP_SERVER_TIME) && !msg.time.IsZero() {
+		// Times are truncated, never reporting a time in the future
+		t := msg.time.UTC().Truncate(time.Millisecond)
+		if s.config.ServerTimeRounding > 0 {
+			t = t.Truncate(time.Duration(s.config.ServerTimeRounding) * time.Second)
+		}
+		tags = append(tags, "time="+t.Format(SERVER_TIME_FORMAT))
+	}
+
+	return strings.Join(tags, ";")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/sorcix/irc.v2"
+)
+
+func TestCapabilityList(t *testing.T) {
+	assert.Equal(t, []string{"message-tags", "sasl", "server-time", "userhost-in-names"}, listCapabilities(0))
+	assert.Contains(t, listCapabilities(302), "sasl=PLAIN,EXTERNAL")
+}
+
+func TestServerTimeTag(t *testing.T) {
+	s := NewServer("")
+	client := NewClient("client", nil, false, nil)
+
+	msg := &ClientMessage{Message: &irc.Message{Command: irc.PRIVMSG}, time: time.Date(2019, 4, 1, 12, 30, 14, 600000000, time.UTC)}
+	assert.Equal(t, "", s.messageTags(client, msg))
+
+	client.enableCapability(CAP_SERVER_TIME)
+	assert.Equal(t, "time=2019-04-01T12:30:14.600Z", s.messageTags(client, msg))
+
+	msg.time = time.Date(2019, 4, 1, 12, 30, 19, 999900000, time.UTC)
+	assert.Equal(t, "time=2019-04-01T12:30:19.999Z", s.messageTags(client, msg))
+
+	s.config.ServerTimeRounding = 10
+	assert.Equal(t, "time=2019-04-01T12:30:10.000Z", s.messageTags(client, msg))
+}
+
+func TestQuitWhileNegotiating(t *testing.T) {
+	s := newTestServer(t)
+
+	c := dialTestClient(t, s)
+	defer c.Close()
+
+	c.send("CAP LS 302", "NICK test", "USER test 0 * :test")
+	c.expect(" CAP * LS ")
+
+	// Clients may quit before registration has completed
+	c.send("QUIT")
+	c.expectClosed()
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -14,7 +15,7 @@ type Channel struct {
 	Entity
 
 	clients *sync.Map
-	logs    map[int64]*ChannelLog
+	logs    *ChannelLogStore
 
 	topic     string
 	topictime int64
@@ -23,6 +24,7 @@ type Channel struct {
 }
 
 type ChannelLog struct {
+	Sequence  int64
 	Timestamp int64
 	Client    string
 	IP        string
@@ -33,12 +35,155 @@ type ChannelLog struct {
 
 const CHANNEL_LOGS_PER_PAGE = 25
 
-func (cl *ChannelLog) Identifier(index int) string {
-	return fmt.Sprintf("%03d%02d", index, cl.Timestamp%100)
+// Log identifiers contain three digits of the log sequence number, limiting the number of entries which may be stored
+const CHANNEL_LOGS_MAX = 999
+
+func (cl *ChannelLog) Identifier() string {
+	return fmt.Sprintf("%03d%02d", cl.Sequence%1000, cl.Timestamp%100)
+}
+
+func (cl *ChannelLog) Print(channel string) string {
+	return strings.TrimSpace(fmt.Sprintf("%s %s %s %4s %s", time.Unix(0, cl.Timestamp).Format(time.Stamp), channel, cl.Identifier(), cl.Action, cl.Message))
+}
+
+// ChannelLogStore is a ring buffer of log entries, the oldest entries are evicted once it is full or they expire
+type ChannelLogStore struct {
+	entries  []*ChannelLog
+	start    int
+	count    int
+	sequence int64 // Sequence number of the next entry
+	maxage   int64 // Maximum age of entries in seconds, 0 to keep entries until they are evicted
+}
+
+func NewChannelLogStore(size int, maxage int64) *ChannelLogStore {
+	s := &ChannelLogStore{}
+	s.Resize(size, maxage)
+
+	return s
+}
+
+func (s *ChannelLogStore) Len() int {
+	return s.count
+}
+
+// Get the entry at the specified index, starting with the oldest entry
+func (s *ChannelLogStore) Get(i int) *ChannelLog {
+	if i < 0 || i >= s.count {
+		return nil
+	}
+
+	return s.entries[(s.start+i)%len(s.entries)]
+}
+
+func (s *ChannelLogStore) Append(l *ChannelLog) {
+	l.Sequence = s.sequence
+	s.sequence++
+
+	if s.count == len(s.entries) {
+		s.entries[s.start] = l
+		s.start = (s.start + 1) % len(s.entries)
+	} else {
+		s.entries[(s.start+s.count)%len(s.entries)] = l
+		s.count++
+	}
+}
+
+// Timestamp of the oldest entry which has not expired
+func (s *ChannelLogStore) cutoff() int64 {
+	if s.maxage <= 0 {
+		return 0
+	}
+
+	return time.Now().UTC().UnixNano() - s.maxage*int64(time.Second)
+}
+
+// Index of the oldest entry which has not expired
+func (s *ChannelLogStore) first() int {
+	cutoff := s.cutoff()
+	return sort.Search(s.count, func(i int) bool {
+		return s.Get(i).Timestamp >= cutoff
+	})
+}
+
+// Remove expired entries
+func (s *ChannelLogStore) Expire() {
+	for i := s.first(); i > 0; i-- {
+		s.entries[s.start] = nil
+		s.start = (s.start + 1) % len(s.entries)
+		s.count--
+	}
+}
+
+func (s *ChannelLogStore) Find(identifier string) *ChannelLog {
+	if len(identifier) != 5 {
+		return nil
+	}
+
+	sequence, err := strconv.Atoi(identifier[0:3])
+	if err != nil || s.count == 0 {
+		return nil
+	}
+
+	// Sequence numbers of stored entries are consecutive
+	oldest := s.sequence - int64(s.count)
+	i := (int64(sequence) - oldest%1000 + 1000) % 1000
+	if i < int64(s.first()) || i >= int64(s.count) {
+		return nil
+	}
+
+	l := s.Get(int(i))
+	if l.Identifier() != identifier {
+		return nil
+	}
+
+	return l
 }
 
-func (cl *ChannelLog) Print(index int, channel string) string {
-	return strings.TrimSpace(fmt.Sprintf("%s %s %s %4s %s", time.Unix(0, cl.Timestamp).Format(time.Stamp), channel, cl.Identifier(index), cl.Action, cl.Message))
+// Change the maximum number of entries and maximum age, evicting the oldest entries when necessary
+func (s *ChannelLogStore) Resize(size int, maxage int64) {
+	if size <= 0 || size > CHANNEL_LOGS_MAX {
+		size = CHANNEL_LOGS_MAX
+	}
+	s.maxage = maxage
+
+	if size == len(s.entries) {
+		return
+	}
+
+	entries := s.Entries()
+	if len(entries) > size {
+		entries = entries[len(entries)-size:]
+	}
+
+	s.entries = make([]*ChannelLog, size)
+	copy(s.entries, entries)
+	s.start = 0
+	s.count = len(entries)
+}
+
+// All entries, starting with the oldest
+func (s *ChannelLogStore) Entries() []*ChannelLog {
+	entries := make([]*ChannelLog, s.count)
+	for i := range entries {
+		entries[i] = s.Get(i)
+	}
+
+	return entries
+}
+
+// Replace all entries, used when resuming after an upgrade
+func (s *ChannelLogStore) Restore(entries []*ChannelLog, sequence int64) {
+	if len(entries) > len(s.entries) {
+		entries = entries[len(entries)-len(s.entries):]
+	}
+
+	for i := range s.entries {
+		s.entries[i] = nil
+	}
+	copy(s.entries, entries)
+	s.start = 0
+	s.count = len(entries)
+	s.sequence = sequence
 }
 
 func NewChannel(identifier string) *Channel {
@@ -46,7 +191,7 @@ func NewChannel(identifier string) *Channel {
 	c.Initialize(ENTITY_CHANNEL, identifier)
 
 	c.clients = new(sync.Map)
-	c.logs = make(map[int64]*ChannelLog)
+	c.logs = NewChannelLogStore(CHANNEL_LOGS_MAX, 0)
 
 	return c
 }
@@ -55,48 +200,54 @@ func (c *Channel) Log(client *Client, action string, message string) {
 	c.Lock()
 	defer c.Unlock()
 
-	// TODO: Log size limiting, max capacity will be 999 entries
-	// Log hash of IP address which is used later when connecting/joining
+	c.logs.Expire()
 
+	// Log hash of IP address which is used later when connecting/joining
 	nano := time.Now().UTC().UnixNano()
-	c.logs[nano] = &ChannelLog{Timestamp: nano, Client: client.identifier, IP: client.iphash, Account: client.account, Action: action, Message: message}
+	c.logs.Append(&ChannelLog{Timestamp: nano, Client: client.identifier, IP: client.iphash, Account: client.account, Action: action, Message: message})
+}
+
+func (c *Channel) SetLogLimits(size int, maxage int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.logs.Resize(size, maxage)
+	c.logs.Expire()
 }
 
 func (c *Channel) RevealLog(page int, showAll bool) []string {
 	c.RLock()
 	defer c.RUnlock()
 
-	// TODO:
-	// Trim old channel logs periodically
-	// Add pagination
 	var ls []string
 	logsRemain := false
-	j := 0
 
-	var nanos int64arr
-	for n := range c.logs {
-		nanos = append(nanos, n)
+	skip := 0
+	if page > 0 {
+		skip = CHANNEL_LOGS_PER_PAGE * (page - 1)
+	}
+
+	i := c.logs.first()
+	if showAll {
+		// All entries match, skip directly to the requested page
+		i += skip
+		skip = 0
 	}
-	sort.Sort(nanos)
 
-	// To perform the opertion you want
-	var l *ChannelLog
-	var ok bool
-	for i, nano := range nanos {
-		if l, ok = c.logs[nano]; !ok {
+	for ; i < c.logs.Len(); i++ {
+		l := c.logs.Get(i)
+		if !showAll && (l.Action == irc.JOIN || l.Action == irc.PART) {
+			continue
+		} else if skip > 0 {
+			skip--
 			continue
 		}
 
-		if page == -1 || i >= (CHANNEL_LOGS_PER_PAGE*(page-1)) {
-			if showAll || (l.Action != irc.JOIN && l.Action != irc.PART) {
-				if page > -1 && j == CHANNEL_LOGS_PER_PAGE {
-					logsRemain = true
-					break
-				}
-				ls = append(ls, l.Print(i, c.identifier))
-				j++
-			}
+		if page > -1 && len(ls) == CHANNEL_LOGS_PER_PAGE {
+			logsRemain = true
+			break
 		}
+		ls = append(ls, l.Print(c.identifier))
 	}
 
 	if len(ls) == 0 {
@@ -119,30 +270,15 @@ func (c *Channel) RevealLog(page int, showAll bool) []string {
 }
 
 func (c *Channel) RevealInfo(identifier string) (string, int64) {
-	if len(identifier) != 5 {
-		return "", 0
-	}
-
 	c.RLock()
 	defer c.RUnlock()
 
-	var nanos int64arr
-	for n := range c.logs {
-		nanos = append(nanos, n)
-	}
-	sort.Sort(nanos)
-
-	var l *ChannelLog
-	var ok bool
-	for i, nano := range nanos {
-		if l, ok = c.logs[nano]; !ok {
-			continue
-		} else if l.Identifier(i) == identifier {
-			return l.IP, l.Account
-		}
+	l := c.logs.Find(identifier)
+	if l == nil {
+		return "", 0
 	}
 
-	return "", 0
+	return l.IP, l.Account
 }
 
 func (c *Channel) HasClient(client string) bool {
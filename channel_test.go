@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelLogStore(t *testing.T) {
+	logs := NewChannelLogStore(3, 0)
+
+	var entries []*ChannelLog
+	for i := 0; i < 5; i++ {
+		l := &ChannelLog{Timestamp: time.Now().UTC().UnixNano()}
+		logs.Append(l)
+		entries = append(entries, l)
+	}
+
+	// Oldest entries are evicted, remaining identifiers are unchanged
+	assert.Equal(t, 3, logs.Len())
+	assert.Equal(t, entries[2:], logs.Entries())
+	assert.Nil(t, logs.Find(entries[1].Identifier()))
+	assert.Equal(t, entries[3], logs.Find(entries[3].Identifier()))
+
+	logs.Resize(2, 0)
+	assert.Equal(t, entries[3:], logs.Entries())
+	assert.Equal(t, entries[4], logs.Find(entries[4].Identifier()))
+
+	// Expired entries are not found and are removed when expiring
+	logs.Resize(2, 60)
+	entries[3].Timestamp -= int64(2 * time.Minute)
+	assert.Nil(t, logs.Find(entries[3].Identifier()))
+	logs.Expire()
+	assert.Equal(t, entries[4:], logs.Entries())
+}
+
+func TestChannelReap(t *testing.T) {
+	s := newTestServer(t)
+	require.NoError(t, s.store.AddChannel(1, &DBChannel{Channel: "#founded"}))
+
+	c := connectTestClient(t, s, "test")
+	defer c.Close()
+
+	// Empty channels are destroyed, founded channels persist their topic and modes
+	c.send("JOIN #open", "JOIN #founded", "TOPIC #founded :Persisted topic", "PING :joined")
+	c.expect("PONG AnonIRC joined")
+	s.getChannel("#founded").addMode("C", "")
+
+	c.send("PART #open", "PART #founded", "PING :parted")
+	c.expect("PONG AnonIRC parted")
+	assert.Nil(t, s.getChannel("#open"))
+	assert.Nil(t, s.getChannel("#founded"))
+
+	c.send("JOIN #founded")
+	assert.Contains(t, c.expect(" 332 "), "#founded :Persisted topic")
+	assert.True(t, s.getChannel("#founded").hasMode("C"))
+
+	// Channels are kept for the grace period after becoming empty
+	s.config.ChannelGracePeriod = 1
+	c.send("JOIN #grace", "PART #grace", "PING :parted")
+	c.expect("PONG AnonIRC parted")
+	require.NotNil(t, s.getChannel("#grace"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.getChannel("#grace") != nil && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Nil(t, s.getChannel("#grace"))
+}
+
+func TestChannelReapPersistUnlocked(t *testing.T) {
+	s := newTestServer(t)
+	require.NoError(t, s.store.AddChannel(1, &DBChannel{Channel: "#founded"}))
+	ch := s.createChannel("#founded")
+	ch.topic = "Persisted"
+
+	// Channel state is persisted without holding the server lock
+	s.Lock()
+	reaped := make(chan struct{})
+	go func() {
+		s.reapChannel(ch)
+		close(reaped)
+	}()
+
+	var dbch DBChannel
+	var err error
+	deadline := time.Now().Add(5 * time.Second)
+	for dbch.Topic == "" && time.Now().Before(deadline) {
+		dbch, err = s.store.Channel("#founded")
+		require.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "Persisted", dbch.Topic)
+	assert.True(t, s.getChannel("#founded") == ch)
+	s.Unlock()
+
+	<-reaped
+	assert.Nil(t, s.getChannel("#founded"))
+}
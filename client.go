@@ -1,18 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
 	"log"
 	"net"
+	"sort"
+	"strconv"
 
 	"sync"
 
 	"strings"
 
 	"fmt"
+	"time"
 
 	irc "gopkg.in/sorcix/irc.v2"
 )
 
+type ClientMessage struct {
+	*irc.Message
+	time time.Time
+}
+
 type Client struct {
 	Entity
 	iphash string
@@ -22,36 +33,111 @@ type Client struct {
 	user    string
 	host    string
 	account int64
+	store   Store
 
 	conn        net.Conn
-	writebuffer chan *irc.Message
+	writebuffer chan *ClientMessage
+	writelock   sync.Mutex // Held while queueing messages and terminating
+
+	reader  *bufio.Reader
+	writer  *irc.Encoder
+	partial string
+
+	capabilities *sync.Map
+	capVersion   int
+	negotiating  bool
+	welcomed     bool
 
-	reader *irc.Decoder
-	writer *irc.Encoder
+	saslMechanism string
+	saslBuffer    string
 
-	capHostInNames bool
+	flood []*TokenBucket
+
+	// Connection limit exceeded by the client, which is disconnected unless it identifies to an exempt account
+	limited error
 
 	wg sync.WaitGroup
 }
 
-func NewClient(identifier string, conn net.Conn, ssl bool) *Client {
+func NewClient(identifier string, conn net.Conn, ssl bool, store Store) *Client {
 	c := &Client{}
 	c.Initialize(ENTITY_CLIENT, identifier)
 
+	c.ssl = ssl
+	c.store = store
+	c.nick = "*"
+	c.capabilities = new(sync.Map)
+	c.writebuffer = make(chan *ClientMessage, writebuffersize)
+
+	if conn != nil {
+		iphash, err := addressHash(conn)
+		if err != nil {
+			return nil
+		}
+
+		c.iphash = iphash
+		c.conn = conn
+		c.reader = bufio.NewReaderSize(conn, CLIENT_READ_BUFFER)
+		c.writer = irc.NewEncoder(conn)
+	}
+
+	return c
+}
+
+// Hash of the remote address of a connection, which identifies clients connecting from the same address
+func addressHash(conn net.Conn) (string, error) {
 	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
 	if err != nil {
-		return nil
+		return "", err
 	}
 
-	c.iphash = generateHash(ip)
-	c.ssl = ssl
-	c.nick = "*"
-	c.conn = conn
-	c.writebuffer = make(chan *irc.Message, writebuffersize)
-	c.reader = irc.NewDecoder(conn)
-	c.writer = irc.NewEncoder(conn)
+	return generateHash(ip), nil
+}
 
-	return c
+func (c *Client) hasCapability(capability string) bool {
+	_, ok := c.capabilities.Load(capability)
+	return ok
+}
+
+func (c *Client) getCapabilities() []string {
+	var caps []string
+	c.capabilities.Range(func(k, v interface{}) bool {
+		caps = append(caps, k.(string))
+		return true
+	})
+	sort.Strings(caps)
+
+	return caps
+}
+
+func (c *Client) enableCapability(capability string) {
+	c.capabilities.Store(capability, true)
+}
+
+func (c *Client) disableCapability(capability string) {
+	c.capabilities.Delete(capability)
+}
+
+func (c *Client) readMessage() (*irc.Message, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		// Retain partially read line in case reading is resumed
+		c.partial += line
+		return nil, err
+	}
+	line = c.partial + line
+	c.partial = ""
+
+	// Message tags sent by clients are discarded
+	if len(line) > 0 && line[0] == '@' {
+		if i := strings.IndexByte(line, ' '); i > 0 {
+			line = line[i+1:]
+		} else {
+			line = ""
+		}
+	}
+
+	return irc.ParseMessage(line), nil
 }
 
 func (c *Client) getAccount() (*DBAccount, error) {
@@ -59,7 +145,7 @@ func (c *Client) getAccount() (*DBAccount, error) {
 		return nil, nil
 	}
 
-	acc, err := db.Account(c.account)
+	acc, err := c.store.Account(c.account)
 	if err != nil {
 		return nil, err
 	}
@@ -77,12 +163,39 @@ func (c *Client) getPrefix() *irc.Prefix {
 }
 
 func (c *Client) write(prefix *irc.Prefix, command string, params []string) {
+	c.writelock.Lock()
+	defer c.writelock.Unlock()
+
 	if c.state == ENTITY_STATE_TERMINATING {
 		return
 	}
 
+	// Numeric replies and capabilities are addressed to the client
+	if _, err := strconv.Atoi(command); err == nil || command == irc.CAP {
+		params = append([]string{c.nick}, params...)
+	}
+
 	c.wg.Add(1)
-	c.writebuffer <- &irc.Message{Prefix: prefix, Command: command, Params: params}
+	c.writebuffer <- &ClientMessage{Message: &irc.Message{Prefix: prefix, Command: command, Params: params}, time: time.Now()}
+}
+
+func (c *Client) terminating() bool {
+	c.writelock.Lock()
+	defer c.writelock.Unlock()
+
+	return c.state == ENTITY_STATE_TERMINATING
+}
+
+// Stop queueing messages, returning false when the client was already terminating
+func (c *Client) terminate() bool {
+	c.writelock.Lock()
+	defer c.writelock.Unlock()
+
+	if c.state == ENTITY_STATE_TERMINATING {
+		return false
+	}
+	c.state = ENTITY_STATE_TERMINATING
+	return true
 }
 
 func (c *Client) writeMessage(command string, params []string) {
@@ -125,12 +238,12 @@ func (c *Client) accessDenied(permissionRequired int) {
 }
 
 func (c *Client) identify(username string, password string) bool {
-	accountid, err := db.Auth(username, password)
+	accountid, err := c.store.Auth(username, password)
 	if err != nil {
 		log.Panicf("%+v", err)
 	}
 
-	account, err := db.Account(accountid)
+	account, err := c.store.Account(accountid)
 	if err != nil {
 		log.Panicf("%+v", err)
 	} else if account.ID == 0 {
@@ -141,12 +254,26 @@ func (c *Client) identify(username string, password string) bool {
 	return true
 }
 
+func (c *Client) certificateFingerprint() string {
+	tlsconn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	state := tlsconn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(state.PeerCertificates[0].Raw))
+}
+
 func (c *Client) getPermission(channel string) int {
 	if c.account == 0 {
 		return PERMISSION_CLIENT
 	}
 
-	p, err := db.GetPermission(c.account, channel)
+	p, err := c.store.GetPermission(c.account, channel)
 	if err != nil {
 		log.Panicf("%+v", err)
 	}
@@ -186,13 +313,13 @@ func (c *Client) permissionRequired(command string) int {
 }
 
 func (c *Client) isBanned(channel string) (bool, string) {
-	b, err := db.BanAddr(c.iphash, channel)
+	b, err := c.store.BanAddr(c.iphash, channel)
 	if err != nil {
 		log.Panicf("%+v", err)
 	}
 
 	if b.Channel == "" && c.account > 0 {
-		b, err = db.BanAccount(c.account, channel)
+		b, err = c.store.BanAccount(c.account, channel)
 		if err != nil {
 			log.Panicf("%+v", err)
 		}
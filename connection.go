@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	DEFAULT_CONNECTION_LIMIT  = 5
+	DEFAULT_CONNECTION_RATE   = 10
+	DEFAULT_CONNECTION_WINDOW = 60
+)
+
+// Connections exceeding limits must complete registration within this amount of time, and are only accepted when they
+// identified to an account listed in ConnectionExempt using SASL or PASS
+const CONNECTION_EXEMPT_TIMEOUT = 10 * time.Second
+
+var ErrTooManyConnections = errors.New("too many connections from your address")
+var ErrConnectionThrottled = errors.New("connecting too fast, try again later")
+
+// ConnectionLimiter tracks concurrent and recent connections per address
+type ConnectionLimiter struct {
+	connections map[string]int
+	recent      map[string][]time.Time
+
+	sync.Mutex
+}
+
+func NewConnectionLimiter() *ConnectionLimiter {
+	return &ConnectionLimiter{connections: make(map[string]int), recent: make(map[string][]time.Time)}
+}
+
+// Forget connection times outside of the window
+func (l *ConnectionLimiter) expire(now time.Time, window time.Duration) {
+	for iphash, times := range l.recent {
+		i := sort.Search(len(times), func(i int) bool {
+			return now.Sub(times[i]) < window
+		})
+		if i == len(times) {
+			delete(l.recent, iphash)
+		} else {
+			l.recent[iphash] = times[i:]
+		}
+	}
+}
+
+// Record a connection from an address, returning an error when the address has too many connections or has connected
+// too many times within the window. A limit or rate of zero or less is not enforced.
+func (l *ConnectionLimiter) connect(iphash string, limit int, rate int, window time.Duration) error {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	l.expire(now, window)
+
+	if limit > 0 && l.connections[iphash] >= limit {
+		return ErrTooManyConnections
+	} else if rate > 0 && len(l.recent[iphash]) >= rate {
+		return ErrConnectionThrottled
+	}
+
+	l.connections[iphash]++
+	l.recent[iphash] = append(l.recent[iphash], now)
+	return nil
+}
+
+// Record a connection which is not limited, such as one resumed after upgrading or from an exempt account
+func (l *ConnectionLimiter) add(iphash string) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.connections[iphash]++
+}
+
+func (l *ConnectionLimiter) disconnect(iphash string) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.connections[iphash]--
+	if l.connections[iphash] <= 0 {
+		delete(l.connections, iphash)
+	}
+}
+
+// Addresses which may not currently connect, sorted by address
+func (l *ConnectionLimiter) throttled(limit int, rate int, window time.Duration) []string {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	l.expire(now, window)
+
+	var iphashes []string
+	for iphash := range l.connections {
+		iphashes = append(iphashes, iphash)
+	}
+	for iphash := range l.recent {
+		if _, ok := l.connections[iphash]; !ok {
+			iphashes = append(iphashes, iphash)
+		}
+	}
+	sort.Strings(iphashes)
+
+	var ts []string
+	for _, iphash := range iphashes {
+		if limit > 0 && l.connections[iphash] >= limit {
+			ts = append(ts, fmt.Sprintf("address %s limited with %d connections", iphash, l.connections[iphash]))
+		} else if times := l.recent[iphash]; rate > 0 && len(times) >= rate {
+			remaining := times[len(times)-rate].Add(window).Sub(now)
+			ts = append(ts, fmt.Sprintf("address %s throttled for %s after %d connections", iphash, remaining.Round(time.Second), len(times)))
+		}
+	}
+	return ts
+}
+
+func (s *Server) connectionWindow() time.Duration {
+	return time.Duration(s.config.ConnectionWindow) * time.Second
+}
+
+// Resolve the accounts listed in ConnectionExempt, which is done when the configuration is loaded
+func (s *Server) loadConnectionExempt() error {
+	exempt := make(map[int64]bool)
+	for _, username := range s.config.ConnectionExempt {
+		a, err := s.store.AccountU(username)
+		if err != nil {
+			return err
+		} else if a.ID == 0 {
+			log.Printf("WARNING: Account %s listed in ConnectionExempt does not exist", username)
+			continue
+		}
+
+		exempt[a.ID] = true
+	}
+
+	s.Lock()
+	s.connectionExempt = exempt
+	s.Unlock()
+
+	return nil
+}
+
+func (s *Server) connectionExempted(accountid int64) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return accountid > 0 && s.connectionExempt[accountid]
+}
+
+// Accept a connection which exceeded limits when the client identified to an exempt account during registration,
+// returning false when the client was disconnected
+func (s *Server) acceptLimited(c *Client) bool {
+	if c.limited == nil {
+		return true
+	} else if !s.connectionExempted(c.account) {
+		c.write(nil, irc.ERROR, []string{"Closing Link: " + c.limited.Error()})
+		s.killClient(c, "")
+		return false
+	}
+
+	s.connections.add(c.iphash)
+	c.limited = nil
+	return true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionLimiter(t *testing.T) {
+	l := NewConnectionLimiter()
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, l.connect("address", 2, 3, time.Minute))
+	}
+	assert.Equal(t, ErrTooManyConnections, l.connect("address", 2, 3, time.Minute))
+	assert.NoError(t, l.connect("other", 2, 3, time.Minute))
+	assert.Len(t, l.throttled(2, 3, time.Minute), 1)
+
+	// Disconnecting frees a connection, but connections are throttled within the window
+	l.disconnect("address")
+	assert.NoError(t, l.connect("address", 2, 3, time.Minute))
+	l.disconnect("address")
+	assert.Equal(t, ErrConnectionThrottled, l.connect("address", 2, 3, time.Minute))
+	assert.NoError(t, l.connect("address", 2, 3, 0))
+}
+
+func TestConnectionExempt(t *testing.T) {
+	s := newTestServer(t)
+	s.config.ConnectionLimit = 1
+	s.config.ConnectionExempt = []string{"admin"}
+	require.NoError(t, s.loadConnectionExempt())
+
+	c := connectTestClient(t, s, "test")
+	defer c.Close()
+
+	// Identifying after connecting does not exempt other connections from the address
+	c.send("IDENTIFY admin password")
+	c.expect("Identified successfully")
+
+	limited := dialTestClient(t, s)
+	defer limited.Close()
+	limited.send("NICK limited", "USER limited 0 * :limited")
+	limited.expect("ERROR :Closing Link: " + ErrTooManyConnections.Error())
+
+	// Clients identifying to an exempt account while registering are accepted
+	exempt := dialTestClient(t, s)
+	defer exempt.Close()
+	exempt.send("PASS admin:password", "NICK exempt", "USER exempt 0 * :exempt")
+	exempt.expect(" 001 ")
+}
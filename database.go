@@ -1,33 +1,37 @@
 package main
 
 import (
-	"encoding/base64"
 	"fmt"
 	"log"
-	"strconv"
 	"strings"
 	"time"
 
-	"github.com/gorilla/securecookie"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 )
 
-const DATABASE_VERSION = 1
+const MAX_USERNAME_LENGTH = 32
 
 var ErrAccountExists = errors.New("account already exists")
 var ErrChannelExists = errors.New("channel already exists")
 var ErrChannelDoesNotExist = errors.New("channel does not exist")
+var ErrBanDoesNotExist = errors.New("ban does not exist")
 
 var tables = map[string][]string{
 	"meta": {
 		"`key` TEXT NULL PRIMARY KEY",
 		"`value` TEXT NULL"},
+	"schema_migrations": {
+		"`version` INTEGER PRIMARY KEY",
+		"`description` TEXT NULL",
+		"`applied` INTEGER NULL"},
 	"accounts": {
 		"`id` INTEGER PRIMARY KEY AUTOINCREMENT",
 		"`username` TEXT NULL",
-		"`password` TEXT NULL"},
+		"`password` TEXT NULL",
+		"`salt` TEXT NOT NULL DEFAULT ''",
+		"`params` TEXT NOT NULL DEFAULT ''"},
 	"channels": {
 		"`channel` TEXT PRIMARY KEY",
 		"`topic` TEXT NULL",
@@ -38,11 +42,34 @@ var tables = map[string][]string{
 		"`account` INTEGER NULL",
 		"`permission` INTEGER NULL"},
 	"bans": {
+		"`id` INTEGER PRIMARY KEY AUTOINCREMENT",
 		"`channel` TEXT NULL",
 		"`type` INTEGER NULL",
 		"`target` TEXT NULL",
 		"`expires` INTEGER NULL",
-		"`reason` TEXT NULL"}}
+		"`reason` TEXT NULL",
+		"`creator` INTEGER NOT NULL DEFAULT 0",
+		"`created` INTEGER NOT NULL DEFAULT 0"},
+	"certificates": {
+		"`fingerprint` TEXT PRIMARY KEY",
+		"`account` INTEGER NULL"},
+	"modes": {
+		"`channel` TEXT NULL",
+		"`mode` TEXT NULL",
+		"`value` TEXT NULL"},
+	"audit": {
+		"`id` INTEGER PRIMARY KEY AUTOINCREMENT",
+		"`channel` TEXT NULL",
+		"`account` INTEGER NULL",
+		"`action` TEXT NULL",
+		"`target` TEXT NULL",
+		"`reason` TEXT NULL",
+		"`time` INTEGER NULL"},
+	"tokens": {
+		"`token` TEXT PRIMARY KEY",
+		"`account` INTEGER NULL",
+		"`channel` TEXT NULL",
+		"`expires` INTEGER NULL"}}
 
 const (
 	BAN_TYPE_ADDRESS = 1
@@ -53,6 +80,8 @@ type DBAccount struct {
 	ID       int64
 	Username string
 	Password string
+	Salt     string
+	Params   string
 }
 
 type DBChannel struct {
@@ -75,27 +104,57 @@ type DBMode struct {
 }
 
 type DBBan struct {
+	ID      int64
 	Channel string
 	Type    int
 	Target  string
 	Expires int64
 	Reason  string
+	Creator int64
+	Created int64
+}
+
+type DBCertificate struct {
+	Fingerprint string
+	Account     int64
+}
+
+type DBAudit struct {
+	ID      int64
+	Channel string
+	Account int64
+	Action  string
+	Target  string
+	Reason  string
+	Time    int64
+}
+
+type DBToken struct {
+	Token   string
+	Account int64
+	Channel string
+	Expires int64
 }
 
 type Database struct {
 	db *sqlx.DB
 }
 
-func (d *Database) Connect(driver string, dataSource string) error {
+// Connect to a database without creating or migrating tables
+func (d *Database) Open(driver string, dataSource string) error {
 	var err error
 	d.db, err = sqlx.Connect(driver, dataSource)
 	if err != nil {
 		return errors.Wrapf(err, "failed to connect to %s database", driver)
 	}
 
-	err = d.CreateTables()
+	return nil
+}
+
+func (d *Database) Connect(driver string, dataSource string) error {
+	err := d.Open(driver, dataSource)
 	if err != nil {
-		return errors.Wrap(err, "failed to create tables")
+		return err
 	}
 
 	err = d.Migrate()
@@ -103,6 +162,11 @@ func (d *Database) Connect(driver string, dataSource string) error {
 		return errors.Wrap(err, "failed to migrate database")
 	}
 
+	err = d.CreateTables()
+	if err != nil {
+		return errors.Wrap(err, "failed to create tables")
+	}
+
 	err = d.Initialize()
 	if err != nil {
 		return errors.Wrap(err, "failed to initialize database")
@@ -122,62 +186,24 @@ func (d *Database) CreateTables() error {
 	return nil
 }
 
-func (d *Database) Migrate() error {
-	rows, err := d.db.Query("SELECT `value` FROM meta WHERE `key`=? LIMIT 1", "version")
-	if p(err) {
-		return errors.Wrap(err, "failed to fetch database version")
-	}
-
-	version := 0
-	for rows.Next() {
-		v := ""
-		err = rows.Scan(&v)
-		if err != nil {
-			return errors.Wrap(err, "failed to fetch database version")
-		}
-
-		version, err = strconv.Atoi(v)
-		if err != nil {
-			version = -1
-		}
-	}
-
-	if version == -1 {
-		log.Panic("Unable to migrate database: database version unknown")
-	} else if version == 0 {
-		_, err := d.db.Exec("UPDATE meta SET `value`=? WHERE `key`=?", strconv.Itoa(DATABASE_VERSION), "version")
-		if err != nil {
-			return errors.Wrap(err, "failed to save database version")
-		}
-	} else if version < DATABASE_VERSION {
-		// DATABASE_VERSION 2 migration queries will go here
-	}
-
-	return nil
+func (d *Database) Initialize() error {
+	return initializeStore(d)
 }
 
-func (d *Database) Initialize() error {
-	a, err := db.Account(1)
+// Random value used to derive identifiers which must not be reversible, generated once per database
+func (d *Database) Secret() (string, error) {
+	_, err := d.db.Exec("INSERT OR IGNORE INTO meta (`key`, `value`) VALUES (?, ?)", "secret", generateToken())
 	if err != nil {
-		return errors.Wrap(err, "failed to initialize")
+		return "", errors.Wrap(err, "failed to generate secret")
 	}
 
-	if a.ID > 0 {
-		return nil // Admin account exists
-	}
-
-	err = d.AddAccount("admin", "password")
+	var secret string
+	err = d.db.Get(&secret, "SELECT `value` FROM meta WHERE `key`=? LIMIT 1", "secret")
 	if err != nil {
-		return errors.Wrap(err, "failed to create initial administrator account")
+		return "", errors.Wrap(err, "failed to fetch secret")
 	}
 
-	ac := &DBChannel{Channel: CHANNEL_SERVER, Topic: "Secret Area of VIP Quality"}
-	d.AddChannel(1, ac)
-
-	uc := &DBChannel{Channel: CHANNEL_LOBBY, Topic: "Welcome to AnonIRC"}
-	d.AddChannel(1, uc)
-
-	return nil
+	return secret, nil
 }
 
 func (d *Database) Close() error {
@@ -210,20 +236,8 @@ func (d *Database) AccountU(username string) (DBAccount, error) {
 	return a, nil
 }
 
-// TODO: Lockout on too many failed attempts
 func (d *Database) Auth(username string, password string) (int64, error) {
-	// TODO: Salt in config
-	a := DBAccount{}
-	err := d.db.Get(&a, "SELECT * FROM accounts WHERE username=? AND password=? LIMIT 1", generateHash(username), generateHash(username+"-"+password))
-	if p(err) {
-		return 0, errors.Wrap(err, "failed to authenticate account")
-	}
-
-	return a.ID, nil
-}
-
-func (d *Database) GenerateToken() string {
-	return base64.URLEncoding.EncodeToString(securecookie.GenerateRandomKey(64))
+	return authenticateAccount(d, username, password)
 }
 
 func (d *Database) AddAccount(username string, password string) error {
@@ -234,7 +248,12 @@ func (d *Database) AddAccount(username string, password string) error {
 		return ErrAccountExists
 	}
 
-	_, err = d.db.Exec("INSERT INTO accounts (username, password) VALUES (?, ?)", generateHash(username), generateHash(username+"-"+password))
+	salt, err := generateSalt()
+	if err != nil {
+		return errors.Wrap(err, "failed to add account")
+	}
+
+	_, err = d.db.Exec("INSERT INTO accounts (username, password, salt, params) VALUES (?, ?, ?, ?)", generateHash(username), hashPassword(password, salt, passwordParams), salt, passwordParams.String())
 	if err != nil {
 		return errors.Wrap(err, "failed to add account")
 	}
@@ -250,16 +269,22 @@ func (d *Database) SetUsername(accountid int64, username string, password string
 		return ErrAccountExists
 	}
 
-	_, err = d.db.Exec("UPDATE accounts SET username=?, password=? WHERE id=?", generateHash(username), generateHash(username+"-"+password), accountid)
+	_, err = d.db.Exec("UPDATE accounts SET username=? WHERE id=?", generateHash(username), accountid)
 	if err != nil {
 		return errors.Wrap(err, "failed to set username")
 	}
 
-	return nil
+	// Passwords hashed before salts were introduced include the username
+	return d.SetPassword(accountid, password)
 }
 
-func (d *Database) SetPassword(accountid int64, username string, password string) error {
-	_, err := d.db.Exec("UPDATE accounts SET password=? WHERE id=?", generateHash(username+"-"+password), accountid)
+func (d *Database) SetPassword(accountid int64, password string) error {
+	salt, err := generateSalt()
+	if err != nil {
+		return errors.Wrap(err, "failed to set password")
+	}
+
+	_, err = d.db.Exec("UPDATE accounts SET password=?, salt=?, params=? WHERE id=?", hashPassword(password, salt, passwordParams), salt, passwordParams.String(), accountid)
 	if err != nil {
 		return errors.Wrap(err, "failed to set password")
 	}
@@ -267,21 +292,86 @@ func (d *Database) SetPassword(accountid int64, username string, password string
 	return nil
 }
 
-// Channels
+// Tokens
 
-func (d *Database) ChannelID(id int64) (DBChannel, error) {
-	c := DBChannel{}
-	err := d.db.Get(&c, "SELECT * FROM channels WHERE id=? LIMIT 1", id)
+// Issue a token which identifies an account to administrators of a channel, replacing any previously issued token
+func (d *Database) AddToken(accountid int64, channel string, expires int64) (string, error) {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to add token")
+	}
+	defer tx.Rollback()
+
+	chh := channelHash(channel)
+	_, err = tx.Exec("DELETE FROM tokens WHERE (account=? AND channel=?) OR `expires` <= ?", accountid, chh, time.Now().Unix())
+	if err != nil {
+		return "", errors.Wrap(err, "failed to add token")
+	}
+
+	token := generateToken()
+	_, err = tx.Exec("INSERT INTO tokens (token, account, channel, `expires`) VALUES (?, ?, ?, ?)", generateHash(token), accountid, chh, expires)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to add token")
+	}
+
+	return token, errors.Wrap(tx.Commit(), "failed to add token")
+}
+
+// Resolve a token issued for a channel to the account it identifies
+func (d *Database) TokenAccount(channel string, token string) (int64, error) {
+	t := DBToken{}
+	err := d.db.Get(&t, "SELECT * FROM tokens WHERE token=? AND channel=? AND `expires` > ? LIMIT 1", generateHash(token), channelHash(channel), time.Now().Unix())
 	if p(err) {
-		return c, errors.Wrap(err, "failed to fetch channel")
+		return 0, errors.Wrap(err, "failed to fetch token")
 	}
 
-	return c, nil
+	return t.Account, nil
 }
 
+// Certificates
+
+func (d *Database) CertificateAccount(fingerprint string) (int64, error) {
+	c := DBCertificate{}
+	if fingerprint == "" {
+		return 0, nil
+	}
+
+	err := d.db.Get(&c, "SELECT * FROM certificates WHERE fingerprint=? LIMIT 1", generateHash(fingerprint))
+	if p(err) {
+		return 0, errors.Wrap(err, "failed to fetch certificate")
+	}
+
+	return c.Account, nil
+}
+
+func (d *Database) AddCertificate(accountid int64, fingerprint string) error {
+	_, err := d.db.Exec("INSERT OR REPLACE INTO certificates (fingerprint, account) VALUES (?, ?)", generateHash(fingerprint), accountid)
+	if err != nil {
+		return errors.Wrap(err, "failed to add certificate")
+	}
+
+	return nil
+}
+
+func (d *Database) DeleteCertificate(accountid int64, fingerprint string) error {
+	_, err := d.db.Exec("DELETE FROM certificates WHERE fingerprint=? AND account=?", generateHash(fingerprint), accountid)
+	if err != nil {
+		return errors.Wrap(err, "failed to delete certificate")
+	}
+
+	return nil
+}
+
+// Channels
+
 func (d *Database) Channel(channel string) (DBChannel, error) {
 	c := DBChannel{}
-	err := d.db.Get(&c, "SELECT * FROM channels WHERE channel=? LIMIT 1", generateHash(channel))
+	err := d.rehashChannel(channel)
+	if err != nil {
+		return c, err
+	}
+
+	err = d.db.Get(&c, "SELECT * FROM channels WHERE channel=? LIMIT 1", channelHash(channel))
 	if p(err) {
 		return c, errors.Wrap(err, "failed to fetch channel by key")
 	}
@@ -289,6 +379,47 @@ func (d *Database) Channel(channel string) (DBChannel, error) {
 	return c, nil
 }
 
+// Channels founded before channel names were case-folded are stored using the hash of the name they were founded with,
+// which can't be folded without knowing the name. Their data is moved to the folded hash once they are accessed using
+// that name, such as when they are next joined.
+func (d *Database) rehashChannel(channel string) error {
+	legacy := generateHash(channel)
+	chh := channelHash(channel)
+	if legacy == chh {
+		return nil
+	}
+
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "failed to rehash channel")
+	}
+	defer tx.Rollback()
+
+	var legacycount, count int
+	err = tx.Get(&legacycount, "SELECT COUNT(*) FROM channels WHERE channel=?", legacy)
+	if err != nil {
+		return errors.Wrap(err, "failed to rehash channel")
+	} else if legacycount == 0 {
+		return nil
+	}
+
+	err = tx.Get(&count, "SELECT COUNT(*) FROM channels WHERE channel=?", chh)
+	if err != nil {
+		return errors.Wrap(err, "failed to rehash channel")
+	} else if count > 0 {
+		return nil // A channel has since been founded using the folded name
+	}
+
+	for _, table := range []string{"channels", "permissions", "bans", "modes", "tokens", "audit"} {
+		_, err = tx.Exec(fmt.Sprintf("UPDATE `%s` SET channel=? WHERE channel=?", table), chh, legacy)
+		if err != nil {
+			return errors.Wrapf(err, "failed to rehash channel %s", table)
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to rehash channel")
+}
+
 func (d *Database) AddChannel(accountid int64, channel *DBChannel) error {
 	ex, err := d.Channel(channel.Channel)
 	if err != nil {
@@ -298,7 +429,7 @@ func (d *Database) AddChannel(accountid int64, channel *DBChannel) error {
 	}
 
 	chch := channel.Channel
-	channel.Channel = generateHash(strings.ToLower(channel.Channel))
+	channel.Channel = channelHash(channel.Channel)
 	_, err = d.db.Exec("INSERT INTO channels (channel, topic, topictime, password) VALUES (?, ?, ?, ?)", channel.Channel, channel.Topic, channel.TopicTime, channel.Password)
 	if err != nil {
 		return errors.Wrap(err, "failed to add channel")
@@ -312,6 +443,109 @@ func (d *Database) AddChannel(accountid int64, channel *DBChannel) error {
 	return nil
 }
 
+// Delete a channel along with its permissions, bans, modes, tokens and audit log
+func (d *Database) DropChannel(channel string) error {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "failed to drop channel")
+	}
+	defer tx.Rollback()
+
+	chh := channelHash(channel)
+	res, err := tx.Exec("DELETE FROM channels WHERE channel=?", chh)
+	if err != nil {
+		return errors.Wrap(err, "failed to drop channel")
+	} else if deleted, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "failed to drop channel")
+	} else if deleted == 0 {
+		return ErrChannelDoesNotExist
+	}
+
+	for _, table := range []string{"permissions", "bans", "modes", "tokens", "audit"} {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM `%s` WHERE channel=?", table), chh)
+		if err != nil {
+			return errors.Wrapf(err, "failed to drop channel %s", table)
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to drop channel")
+}
+
+func (d *Database) SetTopic(channel string, topic string, topictime int64) error {
+	_, err := d.db.Exec("UPDATE channels SET topic=?, topictime=? WHERE channel=?", topic, topictime, channelHash(channel))
+	if err != nil {
+		return errors.Wrap(err, "failed to set topic")
+	}
+
+	return nil
+}
+
+// Modes
+
+func (d *Database) Modes(channel string) ([]DBMode, error) {
+	var modes []DBMode
+	err := d.db.Select(&modes, "SELECT * FROM modes WHERE channel=?", channelHash(channel))
+	if p(err) {
+		return nil, errors.Wrap(err, "failed to fetch modes")
+	}
+
+	return modes, nil
+}
+
+func (d *Database) SetMode(channel string, mode string, value string) error {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "failed to set mode")
+	}
+	defer tx.Rollback()
+
+	chh := channelHash(channel)
+	_, err = tx.Exec("DELETE FROM modes WHERE channel=? AND mode=?", chh, mode)
+	if err != nil {
+		return errors.Wrap(err, "failed to set mode")
+	}
+
+	_, err = tx.Exec("INSERT INTO modes (channel, mode, value) VALUES (?, ?, ?)", chh, mode, value)
+	if err != nil {
+		return errors.Wrap(err, "failed to set mode")
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to set mode")
+}
+
+// Replace all modes of a channel
+func (d *Database) SetModes(channel string, modes map[string]string) error {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "failed to set modes")
+	}
+	defer tx.Rollback()
+
+	chh := channelHash(channel)
+	_, err = tx.Exec("DELETE FROM modes WHERE channel=?", chh)
+	if err != nil {
+		return errors.Wrap(err, "failed to set modes")
+	}
+
+	for mode, value := range modes {
+		_, err = tx.Exec("INSERT INTO modes (channel, mode, value) VALUES (?, ?, ?)", chh, mode, value)
+		if err != nil {
+			return errors.Wrap(err, "failed to set modes")
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to set modes")
+}
+
+func (d *Database) DeleteMode(channel string, mode string) error {
+	_, err := d.db.Exec("DELETE FROM modes WHERE channel=? AND mode=?", channelHash(channel), mode)
+	if err != nil {
+		return errors.Wrap(err, "failed to delete mode")
+	}
+
+	return nil
+}
+
 // Permissions
 
 func (d *Database) GetPermission(accountid int64, channel string) (DBPermission, error) {
@@ -320,7 +554,7 @@ func (d *Database) GetPermission(accountid int64, channel string) (DBPermission,
 	// Return REGISTERED by default
 	dbp.Permission = PERMISSION_REGISTERED
 
-	err := d.db.Get(&dbp, "SELECT * FROM permissions WHERE account=? AND channel=? LIMIT 1", accountid, generateHash(channel))
+	err := d.db.Get(&dbp, "SELECT * FROM permissions WHERE account=? AND channel=? LIMIT 1", accountid, channelHash(channel))
 	if p(err) {
 		return dbp, errors.Wrap(err, "failed to fetch permission")
 	}
@@ -328,6 +562,17 @@ func (d *Database) GetPermission(accountid int64, channel string) (DBPermission,
 	return dbp, nil
 }
 
+// All permissions of a channel, highest first
+func (d *Database) Permissions(channel string) ([]DBPermission, error) {
+	var permissions []DBPermission
+	err := d.db.Select(&permissions, "SELECT * FROM permissions WHERE channel=? GROUP BY account ORDER BY permission DESC, account", channelHash(channel))
+	if p(err) {
+		return nil, errors.Wrap(err, "failed to fetch permissions")
+	}
+
+	return permissions, nil
+}
+
 func (d *Database) SetPermission(accountid int64, channel string, permission int) error {
 	acc, err := d.Account(accountid)
 	if err != nil {
@@ -342,9 +587,9 @@ func (d *Database) SetPermission(accountid int64, channel string, permission int
 	} else if ch.Channel == "" {
 		return nil
 	}
-	chh := generateHash(channel)
+	chh := channelHash(channel)
 
-	dbp, err := d.GetPermission(accountid, chh)
+	dbp, err := d.GetPermission(accountid, channel)
 	if err != nil {
 		return errors.Wrap(err, "failed to set permission")
 	}
@@ -364,9 +609,18 @@ func (d *Database) SetPermission(accountid int64, channel string, permission int
 	return nil
 }
 
+func (d *Database) DeletePermission(accountid int64, channel string) error {
+	_, err := d.db.Exec("DELETE FROM permissions WHERE account=? AND channel=?", accountid, channelHash(channel))
+	if err != nil {
+		return errors.Wrap(err, "failed to delete permission")
+	}
+
+	return nil
+}
+
 // Bans
 
-func (d *Database) Ban(banid int) (DBBan, error) {
+func (d *Database) Ban(banid int64) (DBBan, error) {
 	b := DBBan{}
 	err := d.db.Get(&b, "SELECT * FROM bans WHERE id=? LIMIT 1", banid)
 	if p(err) {
@@ -382,7 +636,7 @@ func (d *Database) BanAddr(addrhash string, channel string) (DBBan, error) {
 		return b, nil
 	}
 
-	err := d.db.Get(&b, "SELECT * FROM bans WHERE channel=? AND `type`=? AND target=? AND (`expires` = 0 OR `expires` > ?)", generateHash(channel), BAN_TYPE_ADDRESS, addrhash, time.Now().Unix())
+	err := d.db.Get(&b, "SELECT * FROM bans WHERE channel=? AND `type`=? AND target=? AND (`expires` = 0 OR `expires` > ?)", channelHash(channel), BAN_TYPE_ADDRESS, addrhash, time.Now().Unix())
 	if p(err) {
 		return b, errors.Wrap(err, "failed to fetch ban")
 	}
@@ -396,7 +650,7 @@ func (d *Database) BanAccount(accountid int64, channel string) (DBBan, error) {
 		return b, nil
 	}
 
-	err := d.db.Get(&b, "SELECT * FROM bans WHERE channel=? AND `type`=? AND target=? AND (`expires` = 0 OR `expires` > ?)", generateHash(channel), BAN_TYPE_ACCOUNT, accountid, time.Now().Unix())
+	err := d.db.Get(&b, "SELECT * FROM bans WHERE channel=? AND `type`=? AND target=? AND (`expires` = 0 OR `expires` > ?)", channelHash(channel), BAN_TYPE_ACCOUNT, accountid, time.Now().Unix())
 	if p(err) {
 		return b, errors.Wrap(err, "failed to fetch ban")
 	}
@@ -404,11 +658,74 @@ func (d *Database) BanAccount(accountid int64, channel string) (DBBan, error) {
 	return b, nil
 }
 
+// Active bans of a channel, oldest first, limit may be -1 to fetch all bans
+func (d *Database) Bans(channel string, offset int, limit int) ([]DBBan, error) {
+	var b []DBBan
+	err := d.db.Select(&b, "SELECT * FROM bans WHERE channel=? AND (`expires` = 0 OR `expires` > ?) ORDER BY id LIMIT ? OFFSET ?", channelHash(channel), time.Now().Unix(), limit, offset)
+	if p(err) {
+		return nil, errors.Wrap(err, "failed to fetch bans")
+	}
+
+	return b, nil
+}
+
 func (d *Database) AddBan(b DBBan) error {
-	_, err := d.db.Exec("INSERT INTO bans (`channel`, `type`, `target`, `expires`, `reason`) VALUES (?, ?, ?, ?, ?)", b.Channel, b.Type, b.Target, b.Expires, b.Reason)
+	_, err := d.db.Exec("INSERT INTO bans (`channel`, `type`, `target`, `expires`, `reason`, `creator`, `created`) VALUES (?, ?, ?, ?, ?, ?, ?)", channelHash(b.Channel), b.Type, b.Target, b.Expires, b.Reason, b.Creator, b.Created)
 	if p(err) {
 		return errors.Wrap(err, "failed to add ban")
 	}
 
 	return nil
 }
+
+func (d *Database) DeleteBan(channel string, banid int64) error {
+	res, err := d.db.Exec("DELETE FROM bans WHERE id=? AND channel=?", banid, channelHash(channel))
+	if err != nil {
+		return errors.Wrap(err, "failed to delete ban")
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "failed to delete ban")
+	} else if deleted == 0 {
+		return ErrBanDoesNotExist
+	}
+
+	return nil
+}
+
+func (d *Database) DeleteExpiredBans() (int64, error) {
+	res, err := d.db.Exec("DELETE FROM bans WHERE `expires` != 0 AND `expires` <= ?", time.Now().Unix())
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to delete expired bans")
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to delete expired bans")
+	}
+
+	return deleted, nil
+}
+
+// Audit
+
+// Fetch audit entries of a channel, oldest first, limit may be -1 to fetch all entries
+func (d *Database) Audit(channel string, offset int, limit int) ([]DBAudit, error) {
+	var a []DBAudit
+	err := d.db.Select(&a, "SELECT * FROM audit WHERE channel=? ORDER BY id LIMIT ? OFFSET ?", channelHash(channel), limit, offset)
+	if p(err) {
+		return nil, errors.Wrap(err, "failed to fetch audit log")
+	}
+
+	return a, nil
+}
+
+func (d *Database) AddAudit(a DBAudit) error {
+	_, err := d.db.Exec("INSERT INTO audit (`channel`, `account`, `action`, `target`, `reason`, `time`) VALUES (?, ?, ?, ?, ?, ?)", channelHash(a.Channel), a.Account, a.Action, a.Target, a.Reason, a.Time)
+	if err != nil {
+		return errors.Wrap(err, "failed to add audit entry")
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -13,7 +14,7 @@ const ENTITY_STATE_TERMINATING = 0
 const ENTITY_STATE_NORMAL = 1
 
 const CLIENT_MODES = "cD"
-const CHANNEL_MODES = "cDiklmprstz"
+const CHANNEL_MODES = "cCDiklmprstz"
 const CHANNEL_MODES_ARG = "kl"
 
 type Entity struct {
@@ -131,7 +132,7 @@ func (e *Entity) printModes(addedmodes map[string]string, removedmodes map[strin
 
 	// Added modes
 	sentsign := false
-	for mode := range addedmodes {
+	for _, mode := range sortedModes(addedmodes) {
 		if !sentsign {
 			m += "+"
 			sentsign = true
@@ -141,7 +142,7 @@ func (e *Entity) printModes(addedmodes map[string]string, removedmodes map[strin
 
 	// Removed modes
 	sentsign = false
-	for mode := range removedmodes {
+	for _, mode := range sortedModes(removedmodes) {
 		if !sentsign {
 			m += "-"
 			sentsign = true
@@ -155,3 +156,13 @@ func (e *Entity) printModes(addedmodes map[string]string, removedmodes map[strin
 
 	return m
 }
+
+func sortedModes(modes map[string]string) []string {
+	var sorted []string
+	for mode := range modes {
+		sorted = append(sorted, mode)
+	}
+	sort.Strings(sorted)
+
+	return sorted
+}
@@ -16,7 +16,7 @@ func TestEntityMode(t *testing.T) {
 
 	assert.Equal(t, "+kp", channel.printModes(modes, nil))
 
-	client := NewClient("client", nil, false)
+	client := NewClient("client", nil, false, nil)
 
 	client.addModes([]string{"ck", "MyAwesomeChannelKey"}) // +k is not a client mode
 
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"time"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// Messages are rate limited separately by type
+const (
+	FLOOD_MESSAGE = iota
+	FLOOD_JOIN
+	FLOOD_COMMAND
+)
+
+const (
+	DEFAULT_FLOOD_MESSAGE_RATE  = 2.0
+	DEFAULT_FLOOD_MESSAGE_BURST = 10
+	DEFAULT_FLOOD_JOIN_RATE     = 0.5
+	DEFAULT_FLOOD_JOIN_BURST    = 5
+	DEFAULT_FLOOD_COMMAND_RATE  = 1.0
+	DEFAULT_FLOOD_COMMAND_BURST = 5
+	DEFAULT_FLOOD_RECVQ         = 8192
+)
+
+// Size of the buffer used to read from clients, which limits the measurable backlog
+const CLIENT_READ_BUFFER = 16384
+
+// TokenBucket permits a burst of messages, refilling at a constant rate
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Create a full token bucket, a rate of zero or less never limits
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Take a token, returning how long to wait until it would have been available
+func (b *TokenBucket) take(now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func floodType(msg *irc.Message) int {
+	switch msg.Command {
+	case irc.JOIN:
+		return FLOOD_JOIN
+	case irc.PRIVMSG, irc.NOTICE:
+		if len(msg.Params) > 0 && strings.EqualFold(msg.Params[0], prefixAnonIRC.Name) {
+			return FLOOD_COMMAND
+		}
+	case irc.MODE:
+	default:
+		if _, ok := commandUsage[strings.ToUpper(msg.Command)]; ok {
+			return FLOOD_COMMAND
+		}
+	}
+
+	return FLOOD_MESSAGE
+}
+
+// Amount of data (in bytes) received from a client which has not yet been processed
+func (c *Client) backlog() int {
+	buffered, _ := c.reader.Peek(c.reader.Buffered())
+	if i := bytes.LastIndexByte(buffered, '\n'); i >= 0 {
+		return i + 1
+	}
+
+	return 0
+}
+
+// Delay processing a message when the client has exceeded its rate, similar to the fakelag of other servers. Reading
+// continues while the client is delayed, and clients with a backlog exceeding FloodRecvQ are disconnected. Replies to
+// keepalive pings are never delayed. Returns false when the client was disconnected.
+func (s *Server) throttle(c *Client, msg *irc.Message) bool {
+	if msg.Command == irc.PONG {
+		return true
+	}
+
+	if c.flood == nil {
+		c.flood = []*TokenBucket{
+			FLOOD_MESSAGE: NewTokenBucket(s.config.FloodMessageRate, s.config.FloodMessageBurst),
+			FLOOD_JOIN:    NewTokenBucket(s.config.FloodJoinRate, s.config.FloodJoinBurst),
+			FLOOD_COMMAND: NewTokenBucket(s.config.FloodCommandRate, s.config.FloodCommandBurst)}
+	}
+
+	delay := c.flood[floodType(msg)].take(time.Now())
+	if delay == 0 {
+		return true
+	}
+
+	if s.config.FloodRecvQ > 0 {
+		// Buffer messages received while delayed, returning early once the backlog may exceed FloodRecvQ. WebSocket
+		// connections fail permanently once a read deadline is reached, their backlog is only measured when delayed.
+		until := time.Now().Add(delay)
+		if _, ws := c.conn.(*WebSocketConn); !ws && c.backlog() <= s.config.FloodRecvQ {
+			c.conn.SetReadDeadline(until)
+			c.reader.Peek(s.config.FloodRecvQ + 1)
+		}
+
+		if c.backlog() > s.config.FloodRecvQ {
+			c.write(nil, irc.ERROR, []string{"Closing Link: Excess Flood"})
+			s.killClient(c, "Excess Flood")
+			return false
+		}
+
+		delay = time.Until(until)
+	}
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return !c.terminating()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/sorcix/irc.v2"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(2, 3)
+	now := b.last
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, time.Duration(0), b.take(now))
+	}
+
+	// Once the burst is exhausted, each message is delayed until the bucket refills
+	assert.Equal(t, 500*time.Millisecond, b.take(now))
+	assert.Equal(t, time.Second, b.take(now))
+
+	now = now.Add(3 * time.Second)
+	assert.Equal(t, time.Duration(0), b.take(now))
+
+	// Buckets never exceed their burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, time.Duration(0), b.take(now))
+	}
+	assert.NotEqual(t, time.Duration(0), b.take(now))
+
+	unlimited := NewTokenBucket(-1, 0)
+	assert.Equal(t, time.Duration(0), unlimited.take(now))
+}
+
+func TestFloodType(t *testing.T) {
+	assert.Equal(t, FLOOD_MESSAGE, floodType(irc.ParseMessage("PRIVMSG #lobby :hello")))
+	assert.Equal(t, FLOOD_COMMAND, floodType(irc.ParseMessage("PRIVMSG AnonIRC :HELP")))
+	assert.Equal(t, FLOOD_COMMAND, floodType(irc.ParseMessage("identify admin password")))
+	assert.Equal(t, FLOOD_JOIN, floodType(irc.ParseMessage("JOIN #lobby")))
+	assert.Equal(t, FLOOD_MESSAGE, floodType(irc.ParseMessage("MODE #lobby +k key")))
+}
+
+func TestThrottle(t *testing.T) {
+	s := newTestServer(t)
+	s.config.FloodCommandRate = 5
+	s.config.FloodCommandBurst = 1
+	s.config.FloodRecvQ = 512
+
+	c := connectTestClient(t, s, "test")
+	defer c.Close()
+
+	// Commands exceeding the rate are delayed until the bucket refills
+	start := time.Now()
+	c.send("INFO", "INFO")
+	c.expect("PRIVMSG test :AnonIRCd")
+	c.expect("PRIVMSG test :AnonIRCd")
+	assert.True(t, time.Since(start) >= 150*time.Millisecond, "command was not delayed")
+
+	// Clients which continue sending while delayed are disconnected
+	c.send("INFO")
+	time.Sleep(50 * time.Millisecond)
+	c.conn.Write([]byte(strings.Repeat("INFO\r\n", 100)))
+	c.expect("ERROR :Closing Link: Excess Flood")
+	c.expectClosed()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Length of the opaque identifiers listed by GRANT and BANS
+const PERMISSION_TOKEN_LENGTH = 10
+
+// Identifier which can't be reversed to the value it was generated from
+func (s *Server) opaqueToken(value string) string {
+	return generateHash(s.secret + "-" + value)[:PERMISSION_TOKEN_LENGTH]
+}
+
+// Opaque identifier of an account with permissions on a channel, which does not reveal the account
+func (s *Server) permissionToken(channel string, accountid int64) string {
+	return s.opaqueToken(fmt.Sprintf("%s-%d", foldChannel(channel), accountid))
+}
+
+// Opaque identifier of the account which performed an action, as listed by GRANT
+func (s *Server) actorToken(channel string, accountid int64) string {
+	if accountid == 0 {
+		return "anonymous"
+	}
+
+	return s.permissionToken(channel, accountid)
+}
+
+// Resolve a token issued via TOKEN, or an identifier listed by GRANT, to an account
+func (s *Server) resolveAccount(channel string, token string) int64 {
+	accountid, err := s.store.TokenAccount(channel, token)
+	if err != nil {
+		log.Panicf("%+v", err)
+	} else if accountid > 0 {
+		return accountid
+	}
+
+	if len(token) != PERMISSION_TOKEN_LENGTH {
+		return 0
+	}
+
+	permissions, err := s.store.Permissions(channel)
+	if err != nil {
+		log.Panicf("%+v", err)
+	}
+
+	for _, dbp := range permissions {
+		if s.permissionToken(channel, dbp.Account) == token {
+			return dbp.Account
+		}
+	}
+
+	return 0
+}
+
+// Permission used when granting permissions, the higher of the client's channel and server permissions
+func (c *Client) grantPermission(channel string) int {
+	permission := c.getPermission(channel)
+	if global := c.globalPermission(); global > permission {
+		permission = global
+	}
+
+	return permission
+}
+
+func (s *Server) handleGrant(c *Client, channel string, params []string) {
+	dbch, err := s.store.Channel(channel)
+	if err != nil {
+		log.Panicf("%+v", err)
+	} else if dbch.Channel == "" {
+		c.sendError("Unable to grant, channel is not founded")
+		return
+	}
+
+	if len(params) == 0 {
+		permissions, err := s.store.Permissions(channel)
+		if err != nil {
+			log.Panicf("%+v", err)
+		}
+
+		c.sendMessage(fmt.Sprintf("Permissions on %s:", channel))
+		for _, dbp := range permissions {
+			c.sendMessage(fmt.Sprintf("%s %s", s.permissionToken(channel, dbp.Account), permissionLabels[dbp.Permission]))
+		}
+		c.sendMessage(fmt.Sprintf("Finished listing %d permissions on %s", len(permissions), channel))
+		return
+	}
+
+	accountid := s.resolveAccount(channel, params[0])
+	if accountid == 0 {
+		c.sendError("Unable to grant, invalid or expired token")
+		return
+	}
+
+	current, err := s.store.GetPermission(accountid, channel)
+	if err != nil {
+		log.Panicf("%+v", err)
+	}
+
+	if len(params) == 1 {
+		c.sendMessage(fmt.Sprintf("%s %s", s.permissionToken(channel, accountid), permissionLabels[current.Permission]))
+		return
+	}
+
+	permission := parsePermission(strings.Join(params[1:], " "))
+	if permission == -1 {
+		c.sendError("Unable to grant, invalid permission, specify one of: " + ALL_PERMISSIONS)
+		return
+	}
+
+	ownPermission := c.grantPermission(channel)
+	if permission >= ownPermission {
+		c.sendError("Unable to grant, you may only grant permissions below your own")
+		return
+	} else if current.Permission >= ownPermission {
+		c.sendError("Unable to grant, that account's permission is not below your own")
+		return
+	}
+
+	if permission == PERMISSION_CLIENT {
+		err = s.store.DeletePermission(accountid, channel)
+	} else {
+		err = s.store.SetPermission(accountid, channel, permission)
+	}
+	if err != nil {
+		log.Panicf("%+v", err)
+	}
+
+	token := s.permissionToken(channel, accountid)
+	s.audit(c, channel, COMMAND_GRANT, token, permissionLabels[permission])
+	if permission == PERMISSION_CLIENT {
+		c.sendMessage(fmt.Sprintf("Removed permissions of %s on %s", token, channel))
+	} else {
+		c.sendMessage(fmt.Sprintf("Granted %s to %s on %s", permissionLabels[permission], token, channel))
+	}
+}
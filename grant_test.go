@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGrant(t *testing.T) {
+	s := newTestServer(t)
+
+	accounts := make(map[string]int64)
+	for _, username := range []string{"founder", "operator", "member"} {
+		accounts[username] = addTestAccount(t, s, username)
+	}
+	require.NoError(t, s.store.AddChannel(accounts["founder"], &DBChannel{Channel: "#grant"}))
+	require.NoError(t, s.store.SetPermission(accounts["operator"], "#grant", PERMISSION_ADMIN))
+
+	token, err := s.store.AddToken(accounts["member"], "#grant", time.Now().Add(TOKEN_EXPIRY).Unix())
+	require.NoError(t, err)
+
+	c := connectTestClient(t, s, "test")
+	defer c.Close()
+
+	c.send("IDENTIFY operator password")
+	c.expect("Identified successfully")
+
+	// Permissions may only be granted below the granting client's own permission
+	c.send("GRANT #grant " + token + " administrator")
+	c.expect("you may only grant permissions below your own")
+
+	// Accounts with permissions equal to or above the granting client's own permission may not be changed
+	c.send("GRANT #grant " + s.permissionToken("#grant", accounts["founder"]) + " vip")
+	c.expect("that account's permission is not below your own")
+
+	p, err := s.store.GetPermission(accounts["founder"], "#grant")
+	require.NoError(t, err)
+	assert.Equal(t, PERMISSION_SUPERADMIN, p.Permission)
+
+	c.send("GRANT #grant " + token + " moderator")
+	c.expect("Granted Moderator")
+
+	p, err = s.store.GetPermission(accounts["member"], "#grant")
+	require.NoError(t, err)
+	assert.Equal(t, PERMISSION_MODERATOR, p.Permission)
+
+	// Audit entries identify the account using the identifier listed by GRANT
+	entries, err := s.store.Audit("#grant", 0, -1)
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+	assert.Equal(t, COMMAND_GRANT, entries[0].Action)
+	assert.Equal(t, s.permissionToken("#grant", accounts["member"]), entries[0].Target)
+	assert.NotEqual(t, strconv.FormatInt(accounts["member"], 10), entries[0].Target)
+}
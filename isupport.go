@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+const DEFAULT_NICKLEN = 30
+const DEFAULT_TOPICLEN = 390
+
+// Maximum number of tokens sent in a single RPL_ISUPPORT line
+const ISUPPORT_TOKENS_PER_LINE = 13
+
+// Build RPL_ISUPPORT tokens from the modes supported by the server and the current configuration
+func (s *Server) isupportTokens() []string {
+	// Keys are required to unset k, remaining mode arguments are only required when setting a mode
+	var keymodes, argmodes, flagmodes string
+	for _, mode := range strings.Split(CHANNEL_MODES, "") {
+		if mode == "k" {
+			keymodes += mode
+		} else if strings.Contains(CHANNEL_MODES_ARG, mode) {
+			argmodes += mode
+		} else {
+			flagmodes += mode
+		}
+	}
+
+	return []string{
+		"CASEMAPPING=ascii",
+		fmt.Sprintf("CHANMODES=b,%s,%s,%s", keymodes, argmodes, flagmodes),
+		"CHANTYPES=" + CHANNEL_SERVER + CHANNEL_LOBBY,
+		"NETWORK=AnonIRC",
+		fmt.Sprintf("NICKLEN=%d", s.config.NickLength),
+		"PREFIX=",
+		fmt.Sprintf("TOPICLEN=%d", s.config.TopicLength),
+	}
+}
+
+func (s *Server) sendISupport(c *Client, tokens []string) {
+	for i := 0; i < len(tokens); i += ISUPPORT_TOKENS_PER_LINE {
+		end := i + ISUPPORT_TOKENS_PER_LINE
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+
+		params := append([]string{}, tokens[i:end]...)
+		c.writeMessage(irc.RPL_ISUPPORT, append(params, "are supported by this server"))
+	}
+}
+
+// Send updated RPL_ISUPPORT tokens to all registered clients when they have changed
+func (s *Server) updateISupport(lasttokens []string) {
+	tokens := s.isupportTokens()
+	if reflect.DeepEqual(tokens, lasttokens) {
+		return
+	}
+
+	for _, cl := range s.getClients("") {
+		if cl.welcomed {
+			s.sendISupport(cl, tokens)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DEFAULT_PORT     = 6667
+	DEFAULT_SSL_PORT = 6697
+)
+
+// ListenerConfig is a [[listener]] entry in the configuration file:
+//
+//	[[listener]]
+//	Label = "ipv6-ssl"
+//	Address = "::"
+//	Port = 6697
+//	SSL = true
+//	SSLCert = "/home/user/anonircd/cert.pem"
+//	SSLKey = "/home/user/anonircd/key.pem"
+//
+// When SSLCert and SSLKey are omitted, the server-wide certificate pair is used.
+type ListenerConfig struct {
+	Label         string
+	Address       string
+	Port          int
+	SSL           bool
+	SSLCert       string
+	SSLKey        string
+	WebSocket     bool
+	WebSocketPath string
+}
+
+type Listener struct {
+	config ListenerConfig
+
+	certificate *tls.Certificate
+	listener    net.Listener
+	raw         net.Listener
+	inherited   net.Listener
+	stop        chan struct{}
+
+	sync.RWMutex
+}
+
+// Address the listener binds to, in host:port form
+func (lc ListenerConfig) address() string {
+	return net.JoinHostPort(lc.Address, strconv.Itoa(lc.Port))
+}
+
+// IPv4 and IPv6 addresses are bound separately, allowing both to be listened on using the same port
+func (lc ListenerConfig) network() string {
+	ip := net.ParseIP(lc.Address)
+	if ip == nil {
+		return "tcp"
+	} else if ip.To4() != nil {
+		return "tcp4"
+	}
+
+	return "tcp6"
+}
+
+func (lc ListenerConfig) String() string {
+	l := lc.address()
+	if lc.SSL {
+		l = "+" + l
+	}
+	if lc.WebSocket {
+		l = "WebSocket " + l
+	}
+	if lc.Label != "" {
+		l = fmt.Sprintf("%s (%s)", lc.Label, l)
+	}
+
+	return l
+}
+
+func NewListener(config ListenerConfig) *Listener {
+	l := &Listener{}
+	l.config = config
+	l.stop = make(chan struct{})
+
+	return l
+}
+
+func (l *Listener) loadCertificate() error {
+	if !l.config.SSL {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.config.SSLCert, l.config.SSLKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to load SSL certificate")
+	}
+
+	l.Lock()
+	l.certificate = &cert
+	l.Unlock()
+
+	return nil
+}
+
+func (l *Listener) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.RLock()
+	defer l.RUnlock()
+
+	return l.certificate, nil
+}
+
+func (l *Listener) listen() (net.Listener, error) {
+	err := l.loadCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	var listen net.Listener
+	if l.inherited != nil {
+		// Listening socket passed by the process which was upgraded
+		listen = l.inherited
+		l.inherited = nil
+	} else {
+		listen, err = net.Listen(l.config.network(), l.config.address())
+		if err != nil {
+			return nil, err
+		}
+	}
+	raw := listen
+
+	if l.config.SSL {
+		listen = tls.NewListener(listen, &tls.Config{GetCertificate: l.getCertificate, ClientAuth: tls.RequestClientCert})
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if l.stopped() {
+		listen.Close()
+		return nil, errors.New("listener stopped")
+	}
+	l.listener = listen
+	l.raw = raw
+
+	return listen, nil
+}
+
+// Duplicate the listening socket so that it may be passed to another process
+func (l *Listener) file() (*os.File, error) {
+	l.RLock()
+	defer l.RUnlock()
+
+	tcplistener, ok := l.raw.(*net.TCPListener)
+	if !ok {
+		return nil, nil
+	}
+
+	return tcplistener.File()
+}
+
+func (l *Listener) stopped() bool {
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop accepting connections, the address is released before Stop returns
+func (l *Listener) Stop() {
+	l.Lock()
+	defer l.Unlock()
+
+	close(l.stop)
+	if l.listener != nil {
+		l.listener.Close()
+	}
+}
+
+func (s *Server) serve(l *Listener) {
+	for {
+		listen, err := l.listen()
+		if err != nil {
+			if l.stopped() {
+				return
+			}
+			log.Printf("Failed to listen on %s: %v", l.config, err)
+
+			select {
+			case <-l.stop:
+				return
+			case <-time.After(1 * time.Minute):
+				continue
+			}
+		}
+		log.Printf("Listening on %s", l.config)
+
+		if l.config.WebSocket {
+			s.serveWebSocket(l, listen)
+		} else {
+			for {
+				conn, err := listen.Accept()
+				if err != nil {
+					if l.stopped() {
+						break
+					}
+
+					log.Println("Error accepting connection:", err)
+					time.Sleep(100 * time.Millisecond)
+					continue
+				}
+				go s.handleConnection(conn, l.config.SSL)
+			}
+		}
+
+		if l.stopped() {
+			log.Printf("Stopped listening on %s", l.config)
+			return
+		}
+	}
+}
+
+func (s *Server) serveWebSocket(l *Listener, listen net.Listener) {
+	path := l.config.WebSocketPath
+	if path == "" {
+		path = "/"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		s.handleWebSocket(w, r, l.config.SSL)
+	})
+
+	server := &http.Server{Handler: mux}
+	err := server.Serve(listen)
+	if err != nil && err != http.ErrServerClosed && !l.stopped() {
+		log.Printf("Error serving WebSocket connections on %s: %v", l.config, err)
+	}
+}
+
+// Listeners defined in the configuration file, or the default plain and SSL listeners when none are defined
+func (s *Server) listenerConfigs() map[string]ListenerConfig {
+	configs := make(map[string]ListenerConfig)
+
+	listeners := s.config.Listener
+	if len(listeners) == 0 {
+		listeners = append(listeners, ListenerConfig{Port: DEFAULT_PORT})
+		if s.config.SSLCert != "" {
+			listeners = append(listeners, ListenerConfig{Port: DEFAULT_SSL_PORT, SSL: true})
+		}
+	}
+
+	for _, lc := range listeners {
+		if lc.Port == 0 {
+			lc.Port = DEFAULT_PORT
+			if lc.SSL {
+				lc.Port = DEFAULT_SSL_PORT
+			}
+		}
+		if lc.SSL && lc.SSLCert == "" {
+			lc.SSLCert = s.config.SSLCert
+			lc.SSLKey = s.config.SSLKey
+		}
+
+		configs[lc.address()] = lc
+	}
+
+	return configs
+}
+
+// Start new listeners and restart those whose configuration has changed
+func (s *Server) updateListeners() {
+	s.Lock()
+	defer s.Unlock()
+
+	configs := s.listenerConfigs()
+	for address, l := range s.listeners {
+		if lc, ok := configs[address]; ok && reflect.DeepEqual(lc, l.config) {
+			// Reload certificate without interrupting the listener
+			err := l.loadCertificate()
+			if err != nil {
+				log.Printf("Failed to reload SSL certificate for %s: %v", l.config, err)
+			}
+			continue
+		}
+
+		l.Stop()
+		delete(s.listeners, address)
+	}
+
+	for address, lc := range configs {
+		if _, ok := s.listeners[address]; ok {
+			continue
+		}
+
+		l := NewListener(lc)
+		if listen, ok := s.inherited[address]; ok {
+			l.inherited = listen
+			delete(s.inherited, address)
+		}
+		s.listeners[address] = l
+		go s.serve(l)
+	}
+
+	// Close listening sockets which are no longer configured
+	for address, listen := range s.inherited {
+		listen.Close()
+		delete(s.inherited, address)
+	}
+}
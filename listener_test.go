@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenerConfigs(t *testing.T) {
+	s := newTestServer(t)
+
+	assert.Equal(t, map[string]ListenerConfig{":6667": {Port: DEFAULT_PORT}}, s.listenerConfigs())
+
+	s.config.SSLCert = "cert.pem"
+	s.config.SSLKey = "key.pem"
+	assert.Equal(t, map[string]ListenerConfig{
+		":6667": {Port: DEFAULT_PORT},
+		":6697": {Port: DEFAULT_SSL_PORT, SSL: true, SSLCert: "cert.pem", SSLKey: "key.pem"}}, s.listenerConfigs())
+
+	// Ports default based on whether SSL is enabled, listeners use the server-wide certificate unless their own is configured
+	s.config.Listener = []ListenerConfig{
+		{Address: "127.0.0.1"},
+		{Address: "::1", SSL: true},
+		{Address: "::1", Port: 7000, SSL: true, SSLCert: "other.pem", SSLKey: "otherkey.pem", WebSocket: true}}
+	assert.Equal(t, map[string]ListenerConfig{
+		"127.0.0.1:6667": {Address: "127.0.0.1", Port: DEFAULT_PORT},
+		"[::1]:6697":     {Address: "::1", Port: DEFAULT_SSL_PORT, SSL: true, SSLCert: "cert.pem", SSLKey: "key.pem"},
+		"[::1]:7000":     {Address: "::1", Port: 7000, SSL: true, SSLCert: "other.pem", SSLKey: "otherkey.pem", WebSocket: true}}, s.listenerConfigs())
+}
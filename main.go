@@ -45,6 +45,11 @@ _|    _|  _|    _|    _|_|    _|    _|  _|_|_|  _|    _|    _|_|_|
 const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
 const writebuffersize = 10
 
+const DEFAULT_SHUTDOWN_MESSAGE = "Server shutting down"
+
+// Maximum amount of time to wait for pending messages to be sent to clients when shutting down
+const SHUTDOWN_TIMEOUT = 5 * time.Second
+
 const (
 	CHANNEL_LOBBY  = "#"
 	CHANNEL_SERVER = "&"
@@ -61,6 +66,7 @@ func main() {
 		Debug      int    `short:"d" long:"debug" description:"Serve pprof data on specified port"`
 		BareLog    bool   `short:"b" long:"bare-log" description:"Don't add current date/time to log entries"`
 		Verbose    bool   `short:"v" long:"verbose" description:"Log verbosely"`
+		DryRun     bool   `long:"migrate-dry-run" description:"Print pending database migrations without applying them and exit"`
 	}
 
 	_, err := flags.Parse(&opts)
@@ -85,8 +91,27 @@ func main() {
 	if err != nil {
 		log.Panicf("%+v", errors.Wrap(err, "failed to load configuration file"))
 	}
-	s.connectDatabase()
-	defer s.closeDatabase()
+
+	if opts.DryRun {
+		s.printPendingMigrations()
+		return
+	}
+	err = s.connectDatabase()
+	if err != nil {
+		log.Panicf("%+v", errors.Wrap(err, "failed to connect to database"))
+	}
+
+	if statefile := os.Getenv(UPGRADE_ENV); statefile != "" {
+		os.Unsetenv(UPGRADE_ENV)
+
+		err = s.resume(statefile)
+		if err != nil {
+			log.Printf("Failed to resume after upgrade: %+v", err)
+			s.loadChannels()
+		}
+	} else {
+		s.loadChannels()
+	}
 
 	sighup := make(chan os.Signal, 1)
 	signal.Notify(sighup, syscall.SIGHUP)
@@ -100,5 +125,13 @@ func main() {
 		}
 	}()
 
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-shutdown
+		s.shutdown()
+		os.Exit(0)
+	}()
+
 	s.listen()
 }
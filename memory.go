@@ -0,0 +1,562 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MemoryStore is a Store which is not persisted, for tests and throwaway instances
+type MemoryStore struct {
+	secret string
+
+	accounts     map[int64]DBAccount
+	accountID    int64
+	channels     map[string]DBChannel
+	permissions  []DBPermission
+	modes        []DBMode
+	bans         []DBBan
+	banID        int64
+	certificates map[string]DBCertificate
+	tokens       map[string]DBToken
+	audit        []DBAudit
+	auditID      int64
+
+	sync.RWMutex
+}
+
+// Create an in-memory store containing the administrator account and default channels
+func NewMemoryStore() *MemoryStore {
+	m := &MemoryStore{}
+	m.secret = generateToken()
+	m.accounts = make(map[int64]DBAccount)
+	m.channels = make(map[string]DBChannel)
+	m.certificates = make(map[string]DBCertificate)
+	m.tokens = make(map[string]DBToken)
+
+	err := initializeStore(m)
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func (m *MemoryStore) Secret() (string, error) {
+	return m.secret, nil
+}
+
+// Accounts
+
+func (m *MemoryStore) Account(id int64) (DBAccount, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.accounts[id], nil
+}
+
+func (m *MemoryStore) accountU(username string) DBAccount {
+	username = generateHash(username)
+	for _, a := range m.accounts {
+		if a.Username == username {
+			return a
+		}
+	}
+
+	return DBAccount{}
+}
+
+func (m *MemoryStore) AccountU(username string) (DBAccount, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.accountU(username), nil
+}
+
+func (m *MemoryStore) Auth(username string, password string) (int64, error) {
+	return authenticateAccount(m, username, password)
+}
+
+func (m *MemoryStore) AddAccount(username string, password string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.accountU(username).ID > 0 {
+		return ErrAccountExists
+	}
+
+	m.accountID++
+	m.accounts[m.accountID] = DBAccount{ID: m.accountID, Username: generateHash(username)}
+	return m.setPassword(m.accountID, password)
+}
+
+func (m *MemoryStore) SetUsername(accountid int64, username string, password string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.accountU(username).ID > 0 {
+		return ErrAccountExists
+	}
+
+	a, ok := m.accounts[accountid]
+	if !ok {
+		return nil
+	}
+	a.Username = generateHash(username)
+	m.accounts[accountid] = a
+
+	// Passwords hashed before salts were introduced include the username
+	return m.setPassword(accountid, password)
+}
+
+func (m *MemoryStore) setPassword(accountid int64, password string) error {
+	a, ok := m.accounts[accountid]
+	if !ok {
+		return nil
+	}
+
+	salt, err := generateSalt()
+	if err != nil {
+		return errors.Wrap(err, "failed to set password")
+	}
+
+	a.Password = hashPassword(password, salt, passwordParams)
+	a.Salt = salt
+	a.Params = passwordParams.String()
+	m.accounts[accountid] = a
+	return nil
+}
+
+func (m *MemoryStore) SetPassword(accountid int64, password string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.setPassword(accountid, password)
+}
+
+// Tokens
+
+func (m *MemoryStore) AddToken(accountid int64, channel string, expires int64) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	chh := channelHash(channel)
+	now := time.Now().Unix()
+	for key, t := range m.tokens {
+		if (t.Account == accountid && t.Channel == chh) || t.Expires <= now {
+			delete(m.tokens, key)
+		}
+	}
+
+	token := generateToken()
+	m.tokens[generateHash(token)] = DBToken{Token: generateHash(token), Account: accountid, Channel: chh, Expires: expires}
+	return token, nil
+}
+
+func (m *MemoryStore) TokenAccount(channel string, token string) (int64, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	t, ok := m.tokens[generateHash(token)]
+	if !ok || t.Channel != channelHash(channel) || t.Expires <= time.Now().Unix() {
+		return 0, nil
+	}
+
+	return t.Account, nil
+}
+
+// Certificates
+
+func (m *MemoryStore) CertificateAccount(fingerprint string) (int64, error) {
+	if fingerprint == "" {
+		return 0, nil
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.certificates[generateHash(fingerprint)].Account, nil
+}
+
+func (m *MemoryStore) AddCertificate(accountid int64, fingerprint string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.certificates[generateHash(fingerprint)] = DBCertificate{Fingerprint: generateHash(fingerprint), Account: accountid}
+	return nil
+}
+
+func (m *MemoryStore) DeleteCertificate(accountid int64, fingerprint string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if c, ok := m.certificates[generateHash(fingerprint)]; ok && c.Account == accountid {
+		delete(m.certificates, generateHash(fingerprint))
+	}
+	return nil
+}
+
+// Channels
+
+func (m *MemoryStore) Channel(channel string) (DBChannel, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.channels[channelHash(channel)], nil
+}
+
+func (m *MemoryStore) AddChannel(accountid int64, channel *DBChannel) error {
+	m.Lock()
+	defer m.Unlock()
+
+	chh := channelHash(channel.Channel)
+	if _, ok := m.channels[chh]; ok {
+		return ErrChannelExists
+	}
+
+	channel.Channel = chh
+	m.channels[chh] = *channel
+	m.setPermission(accountid, chh, PERMISSION_SUPERADMIN)
+	return nil
+}
+
+func (m *MemoryStore) DropChannel(channel string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	chh := channelHash(channel)
+	if _, ok := m.channels[chh]; !ok {
+		return ErrChannelDoesNotExist
+	}
+	delete(m.channels, chh)
+
+	var permissions []DBPermission
+	for _, dbp := range m.permissions {
+		if dbp.Channel != chh {
+			permissions = append(permissions, dbp)
+		}
+	}
+	m.permissions = permissions
+
+	var bans []DBBan
+	for _, b := range m.bans {
+		if b.Channel != chh {
+			bans = append(bans, b)
+		}
+	}
+	m.bans = bans
+
+	m.deleteModes(chh, "")
+
+	for key, t := range m.tokens {
+		if t.Channel == chh {
+			delete(m.tokens, key)
+		}
+	}
+
+	var audit []DBAudit
+	for _, a := range m.audit {
+		if a.Channel != chh {
+			audit = append(audit, a)
+		}
+	}
+	m.audit = audit
+
+	return nil
+}
+
+func (m *MemoryStore) SetTopic(channel string, topic string, topictime int64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	chh := channelHash(channel)
+	if ch, ok := m.channels[chh]; ok {
+		ch.Topic = topic
+		ch.TopicTime = topictime
+		m.channels[chh] = ch
+	}
+	return nil
+}
+
+// Modes
+
+func (m *MemoryStore) Modes(channel string) ([]DBMode, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	chh := channelHash(channel)
+	var modes []DBMode
+	for _, mode := range m.modes {
+		if mode.Channel == chh {
+			modes = append(modes, mode)
+		}
+	}
+
+	return modes, nil
+}
+
+// Delete a mode of a channel, or all modes when mode is empty
+func (m *MemoryStore) deleteModes(chh string, mode string) {
+	var modes []DBMode
+	for _, dbm := range m.modes {
+		if dbm.Channel != chh || (mode != "" && dbm.Mode != mode) {
+			modes = append(modes, dbm)
+		}
+	}
+	m.modes = modes
+}
+
+func (m *MemoryStore) SetMode(channel string, mode string, value string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	chh := channelHash(channel)
+	m.deleteModes(chh, mode)
+	m.modes = append(m.modes, DBMode{Channel: chh, Mode: mode, Value: value})
+	return nil
+}
+
+func (m *MemoryStore) SetModes(channel string, modes map[string]string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	chh := channelHash(channel)
+	m.deleteModes(chh, "")
+	for mode, value := range modes {
+		m.modes = append(m.modes, DBMode{Channel: chh, Mode: mode, Value: value})
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteMode(channel string, mode string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.deleteModes(channelHash(channel), mode)
+	return nil
+}
+
+// Permissions
+
+func (m *MemoryStore) GetPermission(accountid int64, channel string) (DBPermission, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	chh := channelHash(channel)
+	for _, dbp := range m.permissions {
+		if dbp.Account == accountid && dbp.Channel == chh {
+			return dbp, nil
+		}
+	}
+
+	// Return REGISTERED by default
+	return DBPermission{Permission: PERMISSION_REGISTERED}, nil
+}
+
+func (m *MemoryStore) Permissions(channel string) ([]DBPermission, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	chh := channelHash(channel)
+	var permissions []DBPermission
+	for _, dbp := range m.permissions {
+		if dbp.Channel == chh {
+			permissions = append(permissions, dbp)
+		}
+	}
+	sort.Slice(permissions, func(i, j int) bool {
+		if permissions[i].Permission != permissions[j].Permission {
+			return permissions[i].Permission > permissions[j].Permission
+		}
+		return permissions[i].Account < permissions[j].Account
+	})
+
+	return permissions, nil
+}
+
+// Set a permission of a channel hash, accounts and channels which don't exist are ignored
+func (m *MemoryStore) setPermission(accountid int64, chh string, permission int) {
+	if _, ok := m.accounts[accountid]; !ok {
+		return
+	} else if _, ok := m.channels[chh]; !ok {
+		return
+	}
+
+	for i, dbp := range m.permissions {
+		if dbp.Account == accountid && dbp.Channel == chh {
+			m.permissions[i].Permission = permission
+			return
+		}
+	}
+
+	m.permissions = append(m.permissions, DBPermission{Channel: chh, Account: accountid, Permission: permission})
+}
+
+func (m *MemoryStore) SetPermission(accountid int64, channel string, permission int) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.setPermission(accountid, channelHash(channel), permission)
+	return nil
+}
+
+func (m *MemoryStore) DeletePermission(accountid int64, channel string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	chh := channelHash(channel)
+	var permissions []DBPermission
+	for _, dbp := range m.permissions {
+		if dbp.Account != accountid || dbp.Channel != chh {
+			permissions = append(permissions, dbp)
+		}
+	}
+	m.permissions = permissions
+	return nil
+}
+
+// Bans
+
+func banActive(b DBBan, now int64) bool {
+	return b.Expires == 0 || b.Expires > now
+}
+
+func (m *MemoryStore) Ban(banid int64) (DBBan, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, b := range m.bans {
+		if b.ID == banid {
+			return b, nil
+		}
+	}
+
+	return DBBan{}, nil
+}
+
+func (m *MemoryStore) findBan(channel string, bantype int, target string) DBBan {
+	m.RLock()
+	defer m.RUnlock()
+
+	chh := channelHash(channel)
+	now := time.Now().Unix()
+	for _, b := range m.bans {
+		if b.Channel == chh && b.Type == bantype && b.Target == target && banActive(b, now) {
+			return b
+		}
+	}
+
+	return DBBan{}
+}
+
+func (m *MemoryStore) BanAddr(addrhash string, channel string) (DBBan, error) {
+	if addrhash == "" {
+		return DBBan{}, nil
+	}
+
+	return m.findBan(channel, BAN_TYPE_ADDRESS, addrhash), nil
+}
+
+func (m *MemoryStore) BanAccount(accountid int64, channel string) (DBBan, error) {
+	if accountid == 0 {
+		return DBBan{}, nil
+	}
+
+	return m.findBan(channel, BAN_TYPE_ACCOUNT, strconv.FormatInt(accountid, 10)), nil
+}
+
+func (m *MemoryStore) Bans(channel string, offset int, limit int) ([]DBBan, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	chh := channelHash(channel)
+	now := time.Now().Unix()
+	var bans []DBBan
+	for _, b := range m.bans {
+		if b.Channel == chh && banActive(b, now) {
+			bans = append(bans, b)
+		}
+	}
+
+	start, end := paginate(len(bans), offset, limit)
+	return bans[start:end], nil
+}
+
+func (m *MemoryStore) AddBan(b DBBan) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.banID++
+	b.ID = m.banID
+	b.Channel = channelHash(b.Channel)
+	m.bans = append(m.bans, b)
+	return nil
+}
+
+func (m *MemoryStore) DeleteBan(channel string, banid int64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	chh := channelHash(channel)
+	for i, b := range m.bans {
+		if b.ID == banid && b.Channel == chh {
+			m.bans = append(m.bans[:i], m.bans[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrBanDoesNotExist
+}
+
+func (m *MemoryStore) DeleteExpiredBans() (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now().Unix()
+	var bans []DBBan
+	for _, b := range m.bans {
+		if banActive(b, now) {
+			bans = append(bans, b)
+		}
+	}
+
+	deleted := int64(len(m.bans) - len(bans))
+	m.bans = bans
+	return deleted, nil
+}
+
+// Audit
+
+func (m *MemoryStore) Audit(channel string, offset int, limit int) ([]DBAudit, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	chh := channelHash(channel)
+	var entries []DBAudit
+	for _, a := range m.audit {
+		if a.Channel == chh {
+			entries = append(entries, a)
+		}
+	}
+
+	start, end := paginate(len(entries), offset, limit)
+	return entries[start:end], nil
+}
+
+func (m *MemoryStore) AddAudit(a DBAudit) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.auditID++
+	a.ID = m.auditID
+	a.Channel = channelHash(a.Channel)
+	m.audit = append(m.audit, a)
+	return nil
+}
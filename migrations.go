@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Migration upgrades the database schema from the previous version to Version
+type Migration struct {
+	Version     int
+	Description string
+	Migrate     func(tx *sqlx.Tx) error
+}
+
+// Migrations are applied in order, each within its own transaction, before any missing tables are created using the
+// current table definitions. Migrations must not refer to the table definitions, which change over time, and instead
+// create any tables they require as they were at that version.
+var migrations = []Migration{
+	{2, "Move channel keys to the modes table", func(tx *sqlx.Tx) error {
+		_, err := tx.Exec("CREATE TABLE IF NOT EXISTS `modes` (`channel` TEXT NULL,`mode` TEXT NULL,`value` TEXT NULL)")
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO modes (`channel`, `mode`, `value`) SELECT `channel`, 'k', `password` FROM channels WHERE `password` IS NOT NULL AND `password` != ''")
+		return err
+	}},
+	{3, "Add password salt and parameters to accounts", func(tx *sqlx.Tx) error {
+		// Existing passwords are rehashed when their account is next authenticated
+		for _, column := range []string{"salt", "params"} {
+			_, err := tx.Exec(fmt.Sprintf("ALTER TABLE accounts ADD COLUMN `%s` TEXT NOT NULL DEFAULT ''", column))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{4, "Identify bans by ID and record their creator", func(tx *sqlx.Tx) error {
+		return rebuildTable(tx, "bans", "CREATE TABLE `bans` (`id` INTEGER PRIMARY KEY AUTOINCREMENT,`channel` TEXT NULL,`type` INTEGER NULL,`target` TEXT NULL,`expires` INTEGER NULL,`reason` TEXT NULL,`creator` INTEGER NOT NULL DEFAULT 0,`created` INTEGER NOT NULL DEFAULT 0)",
+			"`channel`, `type`, `target`, `expires`, `reason`")
+	}},
+}
+
+// Schema version of the current table definitions
+var DATABASE_VERSION = migrations[len(migrations)-1].Version
+
+// Recreate a table using the provided CREATE TABLE statement, copying the specified columns
+func rebuildTable(tx *sqlx.Tx, table string, create string, columns string) error {
+	previous := table + "_migrate"
+	for _, query := range []string{
+		fmt.Sprintf("ALTER TABLE `%s` RENAME TO `%s`", table, previous),
+		create,
+		fmt.Sprintf("INSERT INTO `%s` (%s) SELECT %s FROM `%s`", table, columns, columns, previous),
+		fmt.Sprintf("DROP TABLE `%s`", previous)} {
+		_, err := tx.Exec(query)
+		if err != nil {
+			return errors.Wrapf(err, "failed to rebuild %s table", table)
+		}
+	}
+
+	return nil
+}
+
+func (d *Database) tableExists(table string) (bool, error) {
+	var count int
+	err := d.db.Get(&count, "SELECT COUNT(*) FROM sqlite_master WHERE `type`='table' AND `name`=?", table)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to check whether %s table exists", table)
+	}
+
+	return count > 0, nil
+}
+
+// Schema version of the database, or 0 when it has not been created
+func (d *Database) Version() (int, error) {
+	var version int
+
+	exists, err := d.tableExists("schema_migrations")
+	if err != nil {
+		return 0, err
+	} else if exists {
+		err = d.db.Get(&version, "SELECT COALESCE(MAX(`version`), 0) FROM schema_migrations")
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to fetch database version")
+		} else if version > 0 {
+			return version, nil
+		}
+	}
+
+	// Databases created before schema_migrations was introduced record their version in the meta table
+	exists, err = d.tableExists("meta")
+	if err != nil {
+		return 0, err
+	} else if exists {
+		var v string
+		err = d.db.Get(&v, "SELECT `value` FROM meta WHERE `key`=? LIMIT 1", "version")
+		if p(err) {
+			return 0, errors.Wrap(err, "failed to fetch database version")
+		} else if v != "" {
+			version, err = strconv.Atoi(v)
+			if err != nil {
+				return 0, errors.Errorf("unknown database version %q", v)
+			}
+			return version, nil
+		}
+	}
+
+	// Databases created before the version was recorded already contain the administrator account
+	exists, err = d.tableExists("accounts")
+	if err != nil {
+		return 0, err
+	} else if exists {
+		err = d.db.Get(&version, "SELECT COUNT(*) FROM accounts WHERE id=1")
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to fetch database version")
+		}
+	}
+
+	return version, nil
+}
+
+// Migrations which have not been applied, returning an error when the database schema is newer than supported
+func (d *Database) PendingMigrations() ([]Migration, error) {
+	version, err := d.Version()
+	if err != nil {
+		return nil, err
+	} else if version > DATABASE_VERSION {
+		return nil, errors.Errorf("database schema version %d is newer than the latest supported version %d", version, DATABASE_VERSION)
+	}
+
+	var pending []Migration
+	if version == 0 {
+		return pending, nil // New databases are created using the current table definitions
+	}
+
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending, nil
+}
+
+func (d *Database) Migrate() error {
+	version, err := d.Version()
+	if err != nil {
+		return err
+	}
+
+	pending, err := d.PendingMigrations()
+	if err != nil {
+		return err
+	}
+
+	if version == 0 {
+		version = DATABASE_VERSION
+	}
+
+	_, err = d.db.Exec("CREATE TABLE IF NOT EXISTS `schema_migrations` (`version` INTEGER PRIMARY KEY,`description` TEXT NULL,`applied` INTEGER NULL)")
+	if err != nil {
+		return errors.Wrap(err, "failed to create schema_migrations table")
+	}
+
+	var recorded int
+	err = d.db.Get(&recorded, "SELECT COUNT(*) FROM schema_migrations")
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch applied migrations")
+	} else if recorded == 0 {
+		// Record the version the database was created with, or migrated to before migrations were recorded
+		_, err = d.db.Exec("INSERT INTO schema_migrations (`version`, `description`, `applied`) VALUES (?, ?, ?)", version, "Baseline", time.Now().Unix())
+		if err != nil {
+			return errors.Wrap(err, "failed to record database version")
+		}
+	}
+
+	for _, m := range pending {
+		err = d.applyMigration(m)
+		if err != nil {
+			return errors.Wrapf(err, "failed to apply migration %d (%s)", m.Version, m.Description)
+		}
+		log.Printf("Applied database migration %d: %s", m.Version, m.Description)
+	}
+
+	return nil
+}
+
+func (d *Database) applyMigration(m Migration) error {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = m.Migrate(tx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO schema_migrations (`version`, `description`, `applied`) VALUES (?, ?, ?)", m.Version, m.Description, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
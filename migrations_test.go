@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Open a temporary database, optionally loading a fixture
+func testDatabase(t *testing.T, fixture string) (*Database, func()) {
+	dir, err := ioutil.TempDir("", "anonircd")
+	require.NoError(t, err)
+
+	d := &Database{}
+	require.NoError(t, d.Open("sqlite3", filepath.Join(dir, "anonircd.db")))
+
+	if fixture != "" {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+		require.NoError(t, err)
+
+		_, err = d.db.Exec(string(data))
+		require.NoError(t, err)
+	}
+
+	return d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMigrateV1(t *testing.T) {
+	d, cleanup := testDatabase(t, "v1.sql")
+	defer cleanup()
+
+	version, err := d.Version()
+	require.NoError(t, err)
+	assert.Equal(t, 1, version)
+
+	// Dry run lists migrations without applying them
+	pending, err := d.PendingMigrations()
+	require.NoError(t, err)
+	assert.Len(t, pending, len(migrations))
+
+	version, err = d.Version()
+	require.NoError(t, err)
+	assert.Equal(t, 1, version)
+
+	require.NoError(t, d.Migrate())
+	require.NoError(t, d.CreateTables())
+
+	version, err = d.Version()
+	require.NoError(t, err)
+	assert.Equal(t, DATABASE_VERSION, version)
+
+	var applied []int
+	require.NoError(t, d.db.Select(&applied, "SELECT `version` FROM schema_migrations ORDER BY `version`"))
+	assert.Equal(t, []int{1, 2, 3, 4}, applied)
+
+	modes, err := d.Modes("#secret")
+	require.NoError(t, err)
+	require.Len(t, modes, 1)
+	assert.Equal(t, "k", modes[0].Mode)
+	assert.Equal(t, "hunter2", modes[0].Value)
+
+	bans, err := d.Bans("#secret", 0, -1)
+	require.NoError(t, err)
+	require.Len(t, bans, 1)
+	assert.Equal(t, int64(1), bans[0].ID)
+	assert.Equal(t, "Spamming", bans[0].Reason)
+
+	// Legacy password hashes are verified and replaced
+	accountid, err := d.Auth("admin", "password")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), accountid)
+
+	a, err := d.Account(1)
+	require.NoError(t, err)
+	assert.Equal(t, passwordParams.String(), a.Params)
+
+	// Migrating again has no effect
+	require.NoError(t, d.Migrate())
+	pending, err = d.PendingMigrations()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestMigrateNewDatabase(t *testing.T) {
+	d, cleanup := testDatabase(t, "")
+	defer cleanup()
+
+	require.NoError(t, d.Migrate())
+	require.NoError(t, d.CreateTables())
+	require.NoError(t, d.Initialize())
+
+	version, err := d.Version()
+	require.NoError(t, err)
+	assert.Equal(t, DATABASE_VERSION, version)
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	d, cleanup := testDatabase(t, "")
+	defer cleanup()
+
+	require.NoError(t, d.CreateTables())
+	_, err := d.db.Exec("INSERT INTO schema_migrations (`version`, `description`, `applied`) VALUES (?, ?, ?)", DATABASE_VERSION+1, "Future", 0)
+	require.NoError(t, err)
+
+	_, err = d.PendingMigrations()
+	assert.Error(t, err)
+	assert.Error(t, d.Migrate())
+}
+
+func TestRehashLegacyChannel(t *testing.T) {
+	d, cleanup := testDatabase(t, "")
+	defer cleanup()
+
+	require.NoError(t, d.Migrate())
+	require.NoError(t, d.CreateTables())
+	require.NoError(t, d.Initialize())
+
+	// Channels founded before names were case-folded are stored using the hash of their original name
+	legacy := generateHash("#Legacy")
+	_, err := d.db.Exec("INSERT INTO channels (channel, topic, topictime, password) VALUES (?, ?, ?, ?)", legacy, "Old topic", 0, "")
+	require.NoError(t, err)
+	_, err = d.db.Exec("INSERT INTO permissions (channel, account, permission) VALUES (?, ?, ?)", legacy, 1, PERMISSION_SUPERADMIN)
+	require.NoError(t, err)
+
+	dbch, err := d.Channel("#legacy")
+	require.NoError(t, err)
+	assert.Empty(t, dbch.Channel)
+
+	dbch, err = d.Channel("#Legacy")
+	require.NoError(t, err)
+	assert.Equal(t, "Old topic", dbch.Topic)
+
+	dbch, err = d.Channel("#LEGACY")
+	require.NoError(t, err)
+	assert.Equal(t, channelHash("#legacy"), dbch.Channel)
+
+	p, err := d.GetPermission(1, "#legacy")
+	require.NoError(t, err)
+	assert.Equal(t, PERMISSION_SUPERADMIN, p.Permission)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+)
+
+const PASSWORD_SALT_LENGTH = 16
+
+// Maximum number of passwords hashed at once, each hash requires the amount of memory specified by its parameters
+const PASSWORD_HASH_CONCURRENCY = 2
+
+var passwordHashing = make(chan struct{}, PASSWORD_HASH_CONCURRENCY)
+
+// PasswordParams are the argon2id parameters used to hash a password, stored alongside each account
+type PasswordParams struct {
+	Time      uint32
+	Memory    uint32
+	Threads   uint8
+	KeyLength uint32
+}
+
+// Passwords are rehashed when they were hashed using different parameters
+var passwordParams = PasswordParams{Time: 1, Memory: 64 * 1024, Threads: 4, KeyLength: 32}
+
+func (pp PasswordParams) String() string {
+	return fmt.Sprintf("argon2id,t=%d,m=%d,p=%d,l=%d", pp.Time, pp.Memory, pp.Threads, pp.KeyLength)
+}
+
+func parsePasswordParams(params string) (PasswordParams, error) {
+	pp := PasswordParams{}
+	_, err := fmt.Sscanf(params, "argon2id,t=%d,m=%d,p=%d,l=%d", &pp.Time, &pp.Memory, &pp.Threads, &pp.KeyLength)
+	if err != nil {
+		return pp, errors.Wrapf(err, "failed to parse password parameters %s", params)
+	}
+
+	return pp, nil
+}
+
+func generateSalt() (string, error) {
+	salt := make([]byte, PASSWORD_SALT_LENGTH)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to generate salt")
+	}
+
+	return base64.StdEncoding.EncodeToString(salt), nil
+}
+
+func hashPassword(password string, salt string, pp PasswordParams) string {
+	passwordHashing <- struct{}{}
+	defer func() { <-passwordHashing }()
+
+	return base64.StdEncoding.EncodeToString(argon2.IDKey([]byte(password), []byte(salt), pp.Time, pp.Memory, pp.Threads, pp.KeyLength))
+}
+
+// Verify the password of an account, accounts without parameters were hashed before salts were introduced
+func verifyPassword(a DBAccount, username string, password string) (bool, error) {
+	var hash string
+	if a.Params == "" {
+		hash = generateHash(username + "-" + password)
+	} else {
+		pp, err := parsePasswordParams(a.Params)
+		if err != nil {
+			return false, err
+		}
+
+		hash = hashPassword(password, a.Salt, pp)
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(a.Password)) == 1, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	legacy := DBAccount{Password: generateHash("admin-password")}
+
+	ok, err := verifyPassword(legacy, "admin", "password")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	salt, err := generateSalt()
+	assert.NoError(t, err)
+
+	a := DBAccount{Password: hashPassword("password", salt, passwordParams), Salt: salt, Params: passwordParams.String()}
+	ok, err = verifyPassword(a, "admin", "password")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = verifyPassword(a, "admin", "hunter2")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	pp, err := parsePasswordParams(a.Params)
+	assert.NoError(t, err)
+	assert.Equal(t, passwordParams, pp)
+}
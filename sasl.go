@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log"
+	"strings"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	SASL_PLAIN    = "PLAIN"
+	SASL_EXTERNAL = "EXTERNAL"
+)
+
+var saslMechanisms = []string{SASL_PLAIN, SASL_EXTERNAL}
+
+// AUTHENTICATE payloads are sent in chunks of 400 bytes, a shorter chunk (or +) ends the payload
+const SASL_CHUNK_LENGTH = 400
+const SASL_MAX_LENGTH = 4096
+
+func (s *Server) handleAuthenticate(c *Client, params []string) {
+	if !c.hasCapability(CAP_SASL) || len(params) == 0 || len(params[0]) == 0 {
+		return
+	}
+
+	if params[0] == "*" {
+		if c.saslMechanism != "" {
+			c.resetSASL()
+			c.writeMessage(irc.ERR_SASLABORTED, []string{"SASL authentication aborted"})
+		}
+		return
+	}
+
+	if c.saslMechanism == "" {
+		if c.account > 0 {
+			c.writeMessage(irc.ERR_SASLALREADY, []string{"You have already authenticated using SASL"})
+			return
+		}
+
+		mechanism := strings.ToUpper(params[0])
+		if !containsString(saslMechanisms, mechanism) {
+			c.writeMessage(irc.RPL_SASLMECHS, []string{strings.Join(saslMechanisms, ","), "are available SASL mechanisms"})
+			c.writeMessage(irc.ERR_SASLFAIL, []string{"SASL authentication failed"})
+			return
+		}
+
+		c.saslMechanism = mechanism
+		c.write(nil, irc.AUTHENTICATE, []string{"+"})
+		return
+	}
+
+	if len(params[0]) > SASL_CHUNK_LENGTH || len(c.saslBuffer)+len(params[0]) > SASL_MAX_LENGTH {
+		c.resetSASL()
+		c.writeMessage(irc.ERR_SASLTOOLONG, []string{"SASL message too long"})
+		return
+	}
+
+	if params[0] != "+" {
+		c.saslBuffer += params[0]
+		if len(params[0]) == SASL_CHUNK_LENGTH {
+			return // Additional chunks follow
+		}
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(c.saslBuffer)
+	mechanism := c.saslMechanism
+	c.resetSASL()
+	if err != nil {
+		c.writeMessage(irc.ERR_SASLFAIL, []string{"SASL authentication failed"})
+		return
+	}
+
+	var accountname string
+	var authSuccess bool
+	switch mechanism {
+	case SASL_PLAIN:
+		// authzid NUL authcid NUL password, an authorization identity must match the authentication identity
+		fields := bytes.Split(payload, []byte{0})
+		if len(fields) == 3 && (len(fields[0]) == 0 || bytes.Equal(fields[0], fields[1])) {
+			accountname = string(fields[1])
+			authSuccess, _ = s.identify(c, accountname, string(fields[2]))
+		}
+	case SASL_EXTERNAL:
+		accountname = string(payload)
+		authSuccess = c.identifyCertificate(accountname)
+	}
+
+	if !authSuccess {
+		c.writeMessage(irc.ERR_SASLFAIL, []string{"SASL authentication failed"})
+		return
+	}
+
+	// Usernames are stored hashed, the username is unknown when a certificate is used without an authorization identity
+	loggedin := "You are now logged in"
+	if accountname != "" {
+		loggedin += " as " + accountname
+	} else {
+		accountname = "*"
+	}
+	c.writeMessage(irc.RPL_LOGGEDIN, []string{c.getPrefix().String(), accountname, loggedin})
+	c.writeMessage(irc.RPL_SASLSUCCESS, []string{"SASL authentication successful"})
+
+	if c.welcomed {
+		s.clientIdentified(c)
+	}
+}
+
+func (c *Client) resetSASL() {
+	c.saslMechanism = ""
+	c.saslBuffer = ""
+}
+
+// Identify using the client certificate, an authorization identity must match the username of its account
+func (c *Client) identifyCertificate(authzid string) bool {
+	accountid, err := c.store.CertificateAccount(c.certificateFingerprint())
+	if err != nil {
+		log.Panicf("%+v", err)
+	} else if accountid == 0 {
+		return false
+	}
+
+	account, err := c.store.Account(accountid)
+	if err != nil {
+		log.Panicf("%+v", err)
+	} else if account.ID == 0 || (authzid != "" && generateHash(authzid) != account.Username) {
+		return false
+	}
+
+	c.account = accountid
+	return true
+}
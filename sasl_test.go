@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Generate a self-signed certificate
+func generateTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "anonircd"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Authenticate while registering, returning the first SASL result
+func authenticateTestClient(c *testClient, mechanism string, payload string) string {
+	c.send("CAP REQ :sasl", "NICK test", "USER test 0 * :test", "AUTHENTICATE "+mechanism)
+	c.expect("AUTHENTICATE +")
+
+	if payload == "" {
+		c.send("AUTHENTICATE +")
+	} else {
+		c.send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte(payload)))
+	}
+	return c.expect(" 90")
+}
+
+func TestSASLPlain(t *testing.T) {
+	s := newTestServer(t)
+
+	c := dialTestClient(t, s)
+	defer c.Close()
+	require.Contains(t, authenticateTestClient(c, SASL_PLAIN, "\x00admin\x00password"), " 900 test test!test@* admin :You are now logged in as admin")
+	c.expect(" 903 ")
+	c.send("CAP END")
+	c.expect(" 001 ")
+
+	// The authorization identity must match the authentication identity
+	c = dialTestClient(t, s)
+	defer c.Close()
+	require.Contains(t, authenticateTestClient(c, SASL_PLAIN, "other\x00admin\x00password"), " 904 ")
+
+	c = dialTestClient(t, s)
+	defer c.Close()
+	require.Contains(t, authenticateTestClient(c, SASL_PLAIN, "admin\x00admin\x00password"), " 900 ")
+
+	c = dialTestClient(t, s)
+	defer c.Close()
+	require.Contains(t, authenticateTestClient(c, SASL_PLAIN, "\x00admin\x00incorrect"), " 904 ")
+}
+
+func TestSASLExternal(t *testing.T) {
+	s := newTestServer(t)
+	accountid := addTestAccount(t, s, "external")
+
+	servercert := generateTestCertificate(t)
+	clientcert := generateTestCertificate(t)
+	require.NoError(t, s.store.AddCertificate(accountid, fmt.Sprintf("%x", sha256.Sum256(clientcert.Certificate[0]))))
+
+	dial := func(cert tls.Certificate) *testClient {
+		addr := listenTestServer(t, s, &tls.Config{Certificates: []tls.Certificate{servercert}, ClientAuth: tls.RequestClientCert})
+		conn, err := tls.Dial("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true})
+		require.NoError(t, err)
+
+		return newTestClient(t, conn)
+	}
+
+	// The username is not known without an authorization identity
+	c := dial(clientcert)
+	defer c.Close()
+	require.Contains(t, authenticateTestClient(c, SASL_EXTERNAL, ""), " 900 test test!test@* * :You are now logged in\r\n")
+
+	c = dial(clientcert)
+	defer c.Close()
+	require.Contains(t, authenticateTestClient(c, SASL_EXTERNAL, "external"), " 900 test test!test@* external :You are now logged in as external")
+
+	c = dial(clientcert)
+	defer c.Close()
+	require.Contains(t, authenticateTestClient(c, SASL_EXTERNAL, "admin"), " 904 ")
+
+	// Unregistered certificates are rejected
+	c = dial(generateTestCertificate(t))
+	defer c.Close()
+	require.Contains(t, authenticateTestClient(c, SASL_EXTERNAL, ""), " 904 ")
+}
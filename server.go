@@ -1,8 +1,6 @@
 package main
 
 import (
-	"crypto/tls"
-	"encoding/base64"
 	"fmt"
 	"log"
 	"math/rand"
@@ -17,8 +15,8 @@ import (
 
 	"github.com/BurntSushi/toml"
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/sha3"
 	"gopkg.in/sorcix/irc.v2"
+	"gopkg.in/sorcix/irc.v2/ctcp"
 )
 
 const (
@@ -31,6 +29,7 @@ const (
 	COMMAND_TOKEN    = "TOKEN"
 	COMMAND_USERNAME = "USERNAME"
 	COMMAND_PASSWORD = "PASSWORD"
+	COMMAND_CERTFP   = "CERTFP"
 
 	// User/channel commands
 	COMMAND_MODE = "MODE"
@@ -42,6 +41,8 @@ const (
 	COMMAND_REVEAL = "REVEAL"
 	COMMAND_KICK   = "KICK"
 	COMMAND_BAN    = "BAN"
+	COMMAND_BANS   = "BANS"
+	COMMAND_UNBAN  = "UNBAN"
 	COMMAND_AUDIT  = "AUDIT"
 
 	// Server admin commands
@@ -74,9 +75,24 @@ var permissionLabels = map[int]string{
 
 var ALL_PERMISSIONS = "Client, Registered Client, VIP, Moderator, Administrator and Super Administrator"
 
+// Parse a permission label or level, returning -1 when it is invalid
+func parsePermission(permission string) int {
+	permission = strings.TrimSpace(permission)
+	for p, label := range permissionLabels {
+		if strings.EqualFold(permission, label) || permission == strconv.Itoa(p) {
+			return p
+		}
+	}
+
+	return -1
+}
+
+// Amount of time account tokens remain valid
+const TOKEN_EXPIRY = 24 * time.Hour
+
 var commandRestrictions = map[int][]string{
-	PERMISSION_REGISTERED: {COMMAND_TOKEN, COMMAND_USERNAME, COMMAND_PASSWORD, COMMAND_FOUND},
-	PERMISSION_MODERATOR:  {COMMAND_MODE, COMMAND_REVEAL, COMMAND_KICK, COMMAND_BAN},
+	PERMISSION_REGISTERED: {COMMAND_TOKEN, COMMAND_USERNAME, COMMAND_PASSWORD, COMMAND_CERTFP, COMMAND_FOUND},
+	PERMISSION_MODERATOR:  {COMMAND_MODE, COMMAND_REVEAL, COMMAND_KICK, COMMAND_BAN, COMMAND_BANS, COMMAND_UNBAN},
 	PERMISSION_ADMIN:      {COMMAND_GRANT, COMMAND_AUDIT},
 	PERMISSION_SUPERADMIN: {COMMAND_DROP, COMMAND_KILL, COMMAND_STATS, COMMAND_REHASH, COMMAND_UPGRADE}}
 
@@ -88,26 +104,34 @@ var commandUsage = map[string][]string{
 	COMMAND_INFO: {"[channel]",
 		"When a channel is specified, prints info including whether it is registered",
 		"Without a channel, server info is printed"},
-	COMMAND_REGISTER: {"<username> <password>",
-		"Create an account",
-		"Once you've registered, other users may GRANT permissions to you, or ",
+	COMMAND_REGISTER: {"<username> <password> <confirm password>",
+		"Create an account and identify to it",
+		"Usernames may only contain letters and numbers",
+		"Once you've registered, other users may GRANT permissions to you, or you may FOUND a channel",
 		"See IDENTIFY"},
 	COMMAND_IDENTIFY: {"[username] <password>",
 		"Identify to a previously registered account",
 		"If username is omitted, it will be replaced with your current nick",
 		"Note that you may automatically identify when connecting by specifying a server password of your username and password separated by a colon - Example:  admin:hunter2"},
 	COMMAND_TOKEN: {"<channel>",
-		"Returns a token which can be used by channel administrators to grant special access to your account"},
+		"Returns a token which can be used by channel administrators to grant special access to your account",
+		fmt.Sprintf("Tokens expire after %.0f hours, requesting a new token replaces the previous one", TOKEN_EXPIRY.Hours())},
 	COMMAND_USERNAME: {"<username> <password> <new username> <confirm new username>",
 		"Change your username"},
 	COMMAND_PASSWORD: {"<username> <password> <new password> <confirm new password>",
 		"Change your password"},
+	COMMAND_CERTFP: {"[add|del]",
+		"View, add or remove the SSL client certificate used to identify via SASL EXTERNAL",
+		"Without an argument, your current certificate fingerprint is printed",
+		"Specify add to identify using your current certificate, or del to stop"},
 	COMMAND_FOUND: {"<channel>",
 		"Take ownership of an unfounded channel"},
 	COMMAND_GRANT: {"<channel> [account] [permission]",
 		"When an account token isn't specified, all accounts with permissions are listed",
 		"Specify an account token and permission level to grant that permission",
 		"Specify an account token only to view that account's permission",
+		"Accounts may be specified by a token obtained via TOKEN or an identifier from the list",
+		"You may only grant permissions below your own, to accounts below your own",
 		"To remove an account's permissions, set their permission to Client",
 		"Permissions: " + ALL_PERMISSIONS},
 	COMMAND_REVEAL: {"<channel> [page] [all]",
@@ -124,26 +148,84 @@ var commandUsage = map[string][]string{
 	COMMAND_BAN: {"<channel> <5 digit log number> <duration> [reason]",
 		"Kick and ban a user from a channel",
 		helpDuration},
+	COMMAND_BANS: {"<channel> [page]",
+		"List active bans, targets are shown as opaque identifiers",
+		fmt.Sprintf("Results start at page 1, %d per page", CHANNEL_LOGS_PER_PAGE),
+		"Page -1 shows all matching entries"},
+	COMMAND_UNBAN: {"<channel> <ban id>",
+		"Remove a ban before it expires, see BANS"},
 	COMMAND_DROP: {"<channel> <confirm channel>",
 		"Delete all channel data, allowing it to be founded again"},
 	COMMAND_KILL: {"<channel> <5 digit log number> <duration> [reason]",
 		"Disconnect and ban a user from the server",
 		helpDuration},
 	COMMAND_STATS: {"",
-		"Print the current number of clients and channels"},
+		"Print the current number of clients and channels, locked accounts and addresses, and throttled addresses"},
 	COMMAND_REHASH: {"",
 		"Reload the server configuration"},
 	COMMAND_UPGRADE: {"",
-		"Upgrade the server without disconnecting clients"},
+		"Upgrade the server without disconnecting clients",
+		"TLS and WebSocket sessions can't be transferred, those clients are asked to reconnect"},
 }
 
 type Config struct {
 	MOTD     string
-	Salt     string
 	DBDriver string
 	DBSource string
 	SSLCert  string
 	SSLKey   string
+
+	Listener []ListenerConfig
+
+	// Origins allowed to connect via WebSocket. When empty, browsers may only connect from pages served by the same host.
+	WebSocketOrigins []string
+
+	NickLength  int
+	TopicLength int
+
+	// Amount of time (in seconds) to keep empty channels in memory. Logs of empty channels are discarded, founded channels
+	// retain their topic and modes in the database.
+	ChannelGracePeriod int
+
+	// Maximum number of log entries kept per channel (up to 999) and maximum age of log entries (in seconds)
+	ChannelLogEntries int
+	ChannelLogAge     int
+
+	// Sent to clients when the server shuts down
+	ShutdownMessage string
+
+	// Failed authentication attempts permitted before further attempts are delayed, the delay (in seconds) doubles with
+	// each additional failure up to AuthMaxLockout
+	AuthAttempts   int
+	AuthLockout    int
+	AuthMaxLockout int
+
+	// Failed authentication attempts from an address before it is banned from the server for AuthBanDuration (in seconds),
+	// or -1 to never ban
+	AuthBanThreshold int
+	AuthBanDuration  int
+
+	// Sustained rate (per second) and burst of channel messages, joins and service commands permitted per client, or a
+	// negative rate to never limit. Clients exceeding a rate are delayed, and disconnected for Excess Flood when more than
+	// FloodRecvQ bytes (below 16384, or -1 to never disconnect) are received while delayed.
+	FloodMessageRate  float64
+	FloodMessageBurst int
+	FloodJoinRate     float64
+	FloodJoinBurst    int
+	FloodCommandRate  float64
+	FloodCommandBurst int
+	FloodRecvQ        int
+
+	// Maximum simultaneous connections per address, and connections permitted per address within ConnectionWindow (in
+	// seconds), or -1 for no limit. Clients which identify to an account listed in ConnectionExempt using SASL or PASS are
+	// exempt.
+	ConnectionLimit  int
+	ConnectionRate   int
+	ConnectionWindow int
+	ConnectionExempt []string
+
+	// Truncate server-time tags to an interval (in seconds) to prevent correlating messages by timing
+	ServerTimeRounding int
 }
 
 type Server struct {
@@ -154,14 +236,22 @@ type Server struct {
 	clients    *sync.Map
 	channels   *sync.Map
 
-	restartplain chan bool
-	restartssl   chan bool
+	listeners map[string]*Listener
+	inherited map[string]net.Listener
+
+	upgradewait   chan struct{}
+	upgradepaused chan *Client
+
+	auth        *AuthLimiter
+	connections *ConnectionLimiter
+	store       Store
+	secret      string
+
+	connectionExempt map[int64]bool
 
 	*sync.RWMutex
 }
 
-var db = &Database{}
-
 func NewServer(configfile string) *Server {
 	s := &Server{}
 	s.config = &Config{}
@@ -170,23 +260,15 @@ func NewServer(configfile string) *Server {
 	s.clients = new(sync.Map)
 	s.channels = new(sync.Map)
 
-	s.restartplain = make(chan bool, 1)
-	s.restartssl = make(chan bool, 1)
+	s.listeners = make(map[string]*Listener)
+	s.inherited = make(map[string]net.Listener)
+	s.auth = NewAuthLimiter()
+	s.connections = NewConnectionLimiter()
 	s.RWMutex = new(sync.RWMutex)
 
 	return s
 }
 
-func (s *Server) hashPassword(username string, password string) string {
-	sha512 := sha3.New512()
-	_, err := sha512.Write([]byte(strings.Join([]string{username, s.config.Salt, password}, "-")))
-	if err != nil {
-		return ""
-	}
-
-	return base64.URLEncoding.EncodeToString(sha512.Sum(nil))
-}
-
 func (s *Server) getAnonymousPrefix(i int) *irc.Prefix {
 	prefix := prefixAnonymous
 	if i > 1 {
@@ -196,13 +278,58 @@ func (s *Server) getAnonymousPrefix(i int) *irc.Prefix {
 }
 
 func (s *Server) getChannel(channel string) *Channel {
-	if ch, ok := s.channels.Load(channel); ok {
+	if ch, ok := s.channels.Load(foldChannel(channel)); ok {
 		return ch.(*Channel)
 	}
 
 	return nil
 }
 
+func validChannel(channel string) bool {
+	return len(channel) > 0 && (channel[0] == '#' || channel[0] == '&')
+}
+
+// Create a channel, restoring its configuration from the database when it has been founded
+func (s *Server) createChannel(channel string) *Channel {
+	ch := NewChannel(channel)
+	s.setLogLimits(ch)
+
+	dbch, err := s.store.Channel(channel)
+	if err != nil {
+		log.Panicf("%+v", err)
+	} else if dbch.Channel != "" {
+		ch.topic = dbch.Topic
+		ch.topictime = dbch.TopicTime
+
+		modes, err := s.store.Modes(channel)
+		if err != nil {
+			log.Panicf("%+v", err)
+		}
+
+		for _, m := range modes {
+			ch.addMode(m.Mode, m.Value)
+		}
+	}
+
+	existing, loaded := s.channels.LoadOrStore(foldChannel(channel), ch)
+	if loaded {
+		return existing.(*Channel)
+	}
+
+	return ch
+}
+
+func (s *Server) setLogLimits(ch *Channel) {
+	ch.SetLogLimits(s.config.ChannelLogEntries, int64(s.config.ChannelLogAge))
+}
+
+// Restore server channels from the database, remaining founded channels are restored when they are joined
+func (s *Server) loadChannels() {
+	for _, channel := range []string{CHANNEL_LOBBY, CHANNEL_SERVER} {
+		s.createChannel(channel)
+	}
+}
+
 func (s *Server) getChannels(client string) map[string]*Channel {
 	channels := make(map[string]*Channel)
 	s.channels.Range(func(k, v interface{}) bool {
@@ -221,7 +348,9 @@ func (s *Server) getChannels(client string) map[string]*Channel {
 func (s *Server) channelCount() int {
 	i := 0
 	s.channels.Range(func(k, v interface{}) bool {
-		i++
+		if v.(*Channel).clientCount() > 0 {
+			i++
+		}
 		return true
 	})
 
@@ -316,10 +445,6 @@ func (s *Server) inChannel(channel string, client string) bool {
 }
 
 func (s *Server) canJoin(c *Client, channel string, key string) (bool, string) {
-	dbch, err := db.Channel(channel)
-	if err != nil || dbch.Channel == "" {
-		return false, "invalid channel"
-	}
 	ch := s.getChannel(channel)
 	if ch == nil {
 		return false, "invalid channel"
@@ -344,9 +469,9 @@ func (s *Server) canJoin(c *Client, channel string, key string) (bool, string) {
 		return false, "invalid channel"
 	}
 
-	if permission < requiredPermission && c.account > 0 {
-		chp, err := db.GetPermission(c.account, channel)
-		if err != nil && chp.Permission > permission {
+	if c.account > 0 {
+		chp, err := s.store.GetPermission(c.account, channel)
+		if err == nil && chp.Permission > permission {
 			permission = chp.Permission
 		}
 	}
@@ -390,18 +515,36 @@ func (s *Server) joinChannel(client string, channel string, key string) {
 		return
 	}
 
-	ch := s.getChannel(channel)
-	if ch == nil {
-		ch = NewChannel(channel)
-		s.channels.Store(channel, ch)
-	} else if canaccess, reason := s.canJoin(cl, channel, key); !canaccess {
-		errmsg := fmt.Sprintf("Cannot join %s: %s", channel, reason)
-		cl.writeMessage(irc.ERR_INVITEONLYCHAN, []string{channel, errmsg})
-		cl.sendNotice(errmsg)
-		return
+	var ch *Channel
+	for {
+		ch = s.getChannel(channel)
+		if ch == nil && validChannel(channel) {
+			ch = s.createChannel(channel)
+		}
+
+		if canaccess, reason := s.canJoin(cl, channel, key); !canaccess {
+			if ch != nil && s.getChannel(channel) != ch {
+				continue // Channel was reaped while being checked
+			} else if ch != nil {
+				s.scheduleReap(ch)
+			}
+
+			errmsg := fmt.Sprintf("Cannot join %s: %s", channel, reason)
+			cl.writeMessage(irc.ERR_INVITEONLYCHAN, []string{channel, errmsg})
+			cl.sendNotice(errmsg)
+			return
+		}
+
+		// Channels are only reaped while holding the lock, retry when the channel was reaped after being checked
+		s.Lock()
+		if s.getChannel(channel) == ch {
+			ch.clients.Store(client, s.anonCount(channel, client)+1)
+			s.Unlock()
+			break
+		}
+		s.Unlock()
 	}
 
-	ch.clients.Store(client, s.anonCount(channel, client)+1)
 	cl.write(cl.getPrefix(), irc.JOIN, []string{channel})
 	ch.Log(cl, irc.JOIN, "")
 
@@ -423,7 +566,46 @@ func (s *Server) partChannel(channel string, client string, reason string) {
 	ch.clients.Delete(client)
 
 	s.updateClientCount(channel, client, reason)
-	// TODO: Destroy empty channel
+	s.scheduleReap(ch)
+}
+
+// Remove a channel from memory once it has been empty for the configured grace period
+func (s *Server) scheduleReap(ch *Channel) {
+	if ch.clientCount() > 0 || ch.identifier == CHANNEL_LOBBY || ch.identifier == CHANNEL_SERVER {
+		return
+	}
+
+	if s.config.ChannelGracePeriod <= 0 {
+		s.reapChannel(ch)
+		return
+	}
+
+	time.AfterFunc(time.Duration(s.config.ChannelGracePeriod)*time.Second, func() {
+		s.reapChannel(ch)
+	})
+}
+
+// Destroy an empty channel and its logs. Founded channels are restored from the database when they are joined again.
+func (s *Server) reapChannel(ch *Channel) {
+	if ch.clientCount() > 0 || s.getChannel(ch.identifier) != ch {
+		return
+	}
+
+	err := s.persistTopic(ch)
+	if err == nil {
+		err = s.persistModes(ch)
+	}
+	if err != nil {
+		log.Printf("Failed to persist %s: %+v", ch.identifier, err)
+	}
+
+	// Clients join while holding the lock, ensuring the channel is not destroyed after being joined
+	s.Lock()
+	defer s.Unlock()
+
+	if ch.clientCount() == 0 && s.getChannel(ch.identifier) == ch {
+		s.channels.Delete(foldChannel(ch.identifier))
+	}
 }
 
 func (s *Server) partAllChannels(client string, reason string) {
@@ -451,6 +633,12 @@ func (s *Server) revealChannelLog(channel string, client string, page int, showA
 	for _, rev := range r {
 		cl.sendMessage(rev)
 	}
+
+	reason := "all entries"
+	if page > -1 {
+		reason = fmt.Sprintf("page %d", page)
+	}
+	s.audit(cl, ch.identifier, COMMAND_REVEAL, "", reason)
 }
 
 func (s *Server) enforceModes(channel string) {
@@ -540,7 +728,7 @@ func (s *Server) sendNames(channel string, clientname string) {
 	}
 
 	names := []string{}
-	if cl.capHostInNames {
+	if cl.hasCapability(CAP_USERHOST_IN_NAMES) {
 		names = append(names, cl.getPrefix().String())
 	} else {
 		names = append(names, cl.nick)
@@ -548,7 +736,7 @@ func (s *Server) sendNames(channel string, clientname string) {
 
 	ccount := s.anonCount(channel, clientname)
 	for i := 1; i < ccount; i++ {
-		if cl.capHostInNames {
+		if cl.hasCapability(CAP_USERHOST_IN_NAMES) {
 			names = append(names, s.getAnonymousPrefix(i).String())
 		} else {
 			names = append(names, s.getAnonymousPrefix(i).Name)
@@ -597,7 +785,7 @@ func (s *Server) handleTopic(channel string, client string, topic string) {
 		return
 	}
 
-	chp, err := db.GetPermission(cl.account, channel)
+	chp, err := s.store.GetPermission(cl.account, channel)
 	if err != nil {
 		log.Panicf("%+v", err)
 	} else if ch.hasMode("t") && chp.Permission < PERMISSION_VIP {
@@ -605,14 +793,24 @@ func (s *Server) handleTopic(channel string, client string, topic string) {
 		return
 	}
 
+	if len(topic) > s.config.TopicLength {
+		topic = topic[:s.config.TopicLength]
+	}
+
 	ch.topic = topic
 	ch.topictime = time.Now().Unix()
 
+	err = s.persistTopic(ch)
+	if err != nil {
+		log.Panicf("%+v", err)
+	}
+
 	ch.clients.Range(func(k, v interface{}) bool {
 		s.sendTopic(channel, k.(string), true)
 		return true
 	})
 	ch.Log(cl, irc.TOPIC, ch.topic)
+	s.audit(cl, ch.identifier, irc.TOPIC, "", ch.topic)
 }
 
 func (s *Server) handleChannelMode(c *Client, params []string) {
@@ -648,8 +846,14 @@ func (s *Server) handleChannelMode(c *Client, params []string) {
 			return
 		}
 
+		err := s.persistModes(ch)
+		if err != nil {
+			log.Panicf("%+v", err)
+		}
+
 		// TODO: Check if local modes were set/unset, only send changes to local client
 		addedmodes, removedmodes := ch.diffModes(lastmodes)
+		s.audit(c, ch.identifier, irc.MODE, "", ch.printModes(addedmodes, removedmodes))
 
 		resendusercount := false
 		if _, ok := addedmodes["c"]; ok {
@@ -737,8 +941,8 @@ func (s *Server) handleMode(c *Client, params []string) {
 		return
 	}
 
-	if len(params) > 1 && params[1] == "b" {
-		c.writeMessage(irc.RPL_ENDOFBANLIST, []string{params[0], "End of Channel Ban List"})
+	if len(params) > 1 && (params[1] == "b" || params[1] == "+b") {
+		s.sendBanList(c, params[0])
 		return
 	}
 
@@ -817,23 +1021,24 @@ func (s *Server) sendUsage(cl *Client, command string) {
 
 }
 
-func (s *Server) ban(channel string, iphash string, accountid int64, expires int64, reason string) error {
+func (s *Server) ban(channel string, iphash string, accountid int64, creator int64, expires int64, reason string) error {
 	if channel == "" || expires < 0 {
 		return nil
 	}
 
 	b := DBBan{}
+	created := time.Now().Unix()
 
 	if iphash != "" {
-		b = DBBan{Channel: generateHash(channel), Type: BAN_TYPE_ADDRESS, Target: iphash, Expires: expires}
-		err := db.AddBan(b)
+		b = DBBan{Channel: channel, Type: BAN_TYPE_ADDRESS, Target: iphash, Expires: expires, Reason: reason, Creator: creator, Created: created}
+		err := s.store.AddBan(b)
 		if err != nil {
 			return err
 		}
 	}
 	if accountid > 0 {
-		b = DBBan{Channel: generateHash(channel), Type: BAN_TYPE_ACCOUNT, Target: fmt.Sprintf("%d", accountid), Expires: expires}
-		err := db.AddBan(b)
+		b = DBBan{Channel: channel, Type: BAN_TYPE_ACCOUNT, Target: fmt.Sprintf("%d", accountid), Expires: expires, Reason: reason, Creator: creator, Created: created}
+		err := s.store.AddBan(b)
 		if err != nil {
 			return err
 		}
@@ -867,6 +1072,25 @@ func (s *Server) ban(channel string, iphash string, accountid int64, expires int
 	return nil
 }
 
+// Apply account permissions and bans after a registered client identifies
+func (s *Server) clientIdentified(c *Client) {
+	if c.globalPermission() >= PERMISSION_VIP {
+		s.joinChannel(c.identifier, CHANNEL_SERVER, "")
+	}
+
+	for clch := range s.getChannels(c.identifier) {
+		banned, br := c.isBanned(clch)
+		if banned {
+			reason := "Banned"
+			if br != "" {
+				reason += ": " + br
+			}
+			s.partChannel(clch, c.identifier, reason)
+			return
+		}
+	}
+}
+
 func (s *Server) handleUserCommand(client string, command string, params []string) {
 	cl := s.getClient(client)
 	if cl == nil {
@@ -901,7 +1125,7 @@ func (s *Server) handleUserCommand(client string, command string, params []strin
 				}
 			}
 
-			dbch, err := db.Channel(params[0])
+			dbch, err := s.store.Channel(params[0])
 			if err != nil {
 				cl.sendError("Failed to fetch channel INFO, " + err.Error())
 				return
@@ -918,13 +1142,35 @@ func (s *Server) handleUserCommand(client string, command string, params []strin
 		}
 		return
 	case COMMAND_REGISTER:
-		if len(params) == 0 {
+		if len(params) < 3 {
 			s.sendUsage(cl, command)
 			return
 		}
 
-		// TODO: Only alphanumeric username
-		// TODO: allow duplicate usernames, only return error on existing username and password
+		if cl.account > 0 {
+			cl.sendError("Unable to register, you are already identified")
+			return
+		} else if !validUsername(params[0]) {
+			cl.sendError(fmt.Sprintf("Unable to register, usernames may only contain up to %d letters and numbers", MAX_USERNAME_LENGTH))
+			return
+		} else if params[1] != params[2] {
+			cl.sendError("Unable to register, passwords don't match")
+			return
+		}
+
+		err = s.store.AddAccount(params[0], params[1])
+		if err == ErrAccountExists {
+			cl.sendError("Unable to register, an account with that username already exists")
+			return
+		} else if err != nil {
+			log.Panicf("%+v", err)
+		}
+
+		if !cl.identify(params[0], params[1]) {
+			log.Panicf("failed to identify to newly registered account %s", params[0])
+		}
+		cl.sendNotice("Registered successfully")
+		s.clientIdentified(cl)
 	case COMMAND_IDENTIFY:
 		if len(params) == 0 || len(params) > 2 {
 			s.sendUsage(cl, command)
@@ -938,30 +1184,39 @@ func (s *Server) handleUserCommand(client string, command string, params []strin
 			password = params[1]
 		}
 
-		authSuccess := cl.identify(username, password)
+		authSuccess, err := s.identify(cl, username, password)
 		if authSuccess {
 			cl.sendNotice("Identified successfully")
-			if cl.globalPermission() >= PERMISSION_VIP {
-				s.joinChannel(cl.identifier, CHANNEL_SERVER, "")
-			}
-
-			for clch := range s.getChannels(cl.identifier) {
-				banned, br := cl.isBanned(clch)
-				if banned {
-					reason := "Banned"
-					if br != "" {
-						reason += ": " + br
-					}
-					s.partChannel(clch, cl.identifier, reason)
-					return
-				}
-			}
+			s.clientIdentified(cl)
+		} else if err != nil {
+			cl.sendNotice("Failed to identify, " + err.Error())
 		} else {
 			cl.sendNotice("Failed to identify, incorrect username/password")
 		}
+	case COMMAND_TOKEN:
+		if len(params) == 0 {
+			s.sendUsage(cl, command)
+			return
+		}
+
+		dbch, err := s.store.Channel(params[0])
+		if err != nil {
+			log.Panicf("%+v", err)
+		} else if dbch.Channel == "" {
+			cl.sendError("Unable to generate token, channel is not founded")
+			return
+		}
+
+		token, err := s.store.AddToken(cl.account, params[0], time.Now().Add(TOKEN_EXPIRY).Unix())
+		if err != nil {
+			log.Panicf("%+v", err)
+		}
+		cl.sendMessage(fmt.Sprintf("Token for %s: %s", params[0], token))
+		cl.sendMessage(fmt.Sprintf("Send this token to an administrator of %s to be granted access, it expires in %.0f hours", params[0], TOKEN_EXPIRY.Hours()))
 	case COMMAND_USERNAME:
 		if cl.account == 0 {
 			cl.sendError("You must identify before using that command")
+			return
 		}
 
 		if len(params) == 0 || len(params) < 4 {
@@ -972,11 +1227,16 @@ func (s *Server) handleUserCommand(client string, command string, params []strin
 		if params[2] != params[3] {
 			cl.sendError("Unable to change username, new usernames don't match")
 			return
+		} else if !validUsername(params[2]) {
+			cl.sendError(fmt.Sprintf("Unable to change username, usernames may only contain up to %d letters and numbers", MAX_USERNAME_LENGTH))
+			return
 		}
-		// TODO: Alphanumeric username
 
-		accid, err := db.Auth(params[0], params[1])
-		if err != nil {
+		accid, err := s.authenticate(cl, params[0], params[1])
+		if err == ErrAuthLocked {
+			cl.sendError("Unable to change username, " + err.Error())
+			return
+		} else if err != nil {
 			log.Panicf("%+v", err)
 		}
 
@@ -985,8 +1245,11 @@ func (s *Server) handleUserCommand(client string, command string, params []strin
 			return
 		}
 
-		err = db.SetUsername(accid, params[2], params[1])
-		if err != nil {
+		err = s.store.SetUsername(accid, params[2], params[1])
+		if err == ErrAccountExists {
+			cl.sendError("Unable to change username, an account with that username already exists")
+			return
+		} else if err != nil {
 			log.Panicf("%+v", err)
 		}
 		cl.sendMessage("Username changed successfully")
@@ -1001,8 +1264,11 @@ func (s *Server) handleUserCommand(client string, command string, params []strin
 			return
 		}
 
-		accid, err := db.Auth(params[0], params[1])
-		if err != nil {
+		accid, err := s.authenticate(cl, params[0], params[1])
+		if err == ErrAuthLocked {
+			cl.sendError("Unable to change password, " + err.Error())
+			return
+		} else if err != nil {
 			log.Panicf("%+v", err)
 		}
 
@@ -1011,20 +1277,110 @@ func (s *Server) handleUserCommand(client string, command string, params []strin
 			return
 		}
 
-		err = db.SetPassword(accid, params[0], params[2])
+		err = s.store.SetPassword(accid, params[2])
 		if err != nil {
 			log.Panicf("%+v", err)
 		}
 		cl.sendMessage("Password changed successfully")
-	case COMMAND_REVEAL, COMMAND_AUDIT:
+	case COMMAND_CERTFP:
+		fingerprint := cl.certificateFingerprint()
+		if fingerprint == "" {
+			cl.sendError("You must connect via SSL using a client certificate to use that command")
+			return
+		}
+
+		if len(params) == 0 {
+			cl.sendMessage("Certificate fingerprint: " + fingerprint)
+			return
+		}
+
+		switch strings.ToLower(params[0]) {
+		case "add":
+			err = s.store.AddCertificate(cl.account, fingerprint)
+			if err != nil {
+				log.Panicf("%+v", err)
+			}
+			cl.sendMessage("Certificate added successfully")
+		case "del":
+			err = s.store.DeleteCertificate(cl.account, fingerprint)
+			if err != nil {
+				log.Panicf("%+v", err)
+			}
+			cl.sendMessage("Certificate removed successfully")
+		default:
+			s.sendUsage(cl, command)
+		}
+	case COMMAND_FOUND:
 		if len(params) == 0 {
 			s.sendUsage(cl, command)
 			return
 		}
 
 		ch := s.getChannel(params[0])
-		if ch == nil {
-			cl.sendError("Unable to reveal, invalid channel specified")
+		if ch == nil || !ch.HasClient(cl.identifier) {
+			cl.sendError("Unable to found, you are not in that channel")
+			return
+		}
+
+		err = s.store.AddChannel(cl.account, &DBChannel{Channel: ch.identifier, Topic: ch.topic, TopicTime: ch.topictime})
+		if err == ErrChannelExists {
+			cl.sendError("Unable to found, channel has already been founded")
+			return
+		} else if err != nil {
+			log.Panicf("%+v", err)
+		}
+
+		err = s.persistModes(ch)
+		if err != nil {
+			log.Panicf("%+v", err)
+		}
+
+		s.audit(cl, ch.identifier, COMMAND_FOUND, "", "")
+		cl.sendMessage(fmt.Sprintf("Founded %s", ch.identifier))
+	case COMMAND_DROP:
+		if len(params) < 2 {
+			s.sendUsage(cl, command)
+			return
+		}
+
+		if !strings.EqualFold(params[0], params[1]) {
+			cl.sendError("Unable to drop, channels don't match")
+			return
+		} else if params[0] == CHANNEL_LOBBY || params[0] == CHANNEL_SERVER {
+			cl.sendError("Unable to drop, server channels may not be dropped")
+			return
+		}
+
+		err = s.store.DropChannel(params[0])
+		if err == ErrChannelDoesNotExist {
+			cl.sendError("Unable to drop, channel is not founded")
+			return
+		} else if err != nil {
+			log.Panicf("%+v", err)
+		}
+
+		s.audit(cl, CHANNEL_SERVER, COMMAND_DROP, params[0], "")
+		cl.sendMessage(fmt.Sprintf("Dropped %s", params[0]))
+
+		if ch := s.getChannel(params[0]); ch != nil {
+			s.scheduleReap(ch)
+		}
+	case COMMAND_GRANT:
+		if len(params) == 0 {
+			s.sendUsage(cl, command)
+			return
+		}
+
+		s.handleGrant(cl, params[0], params[1:])
+	case COMMAND_REVEAL, COMMAND_AUDIT, COMMAND_BANS:
+		if len(params) == 0 {
+			s.sendUsage(cl, command)
+			return
+		}
+
+		action := strings.ToLower(command)
+		if !validChannel(params[0]) {
+			cl.sendError(fmt.Sprintf("Unable to %s, invalid channel specified", action))
 			return
 		}
 
@@ -1038,7 +1394,7 @@ func (s *Server) handleUserCommand(client string, command string, params []strin
 					page = -1
 					all = true
 				} else {
-					cl.sendError("Unable to reveal, invalid page specified")
+					cl.sendError(fmt.Sprintf("Unable to %s, invalid page specified", action))
 					return
 				}
 			}
@@ -1050,10 +1406,13 @@ func (s *Server) handleUserCommand(client string, command string, params []strin
 			}
 		}
 
-		if command == COMMAND_REVEAL {
+		switch command {
+		case COMMAND_REVEAL:
 			s.revealChannelLog(params[0], cl.identifier, page, all)
-		} else {
-			// TODO: Audit
+		case COMMAND_AUDIT:
+			s.revealAuditLog(params[0], cl.identifier, page)
+		case COMMAND_BANS:
+			s.listBans(params[0], cl.identifier, page)
 		}
 	case COMMAND_KICK:
 		if len(params) < 2 {
@@ -1078,6 +1437,7 @@ func (s *Server) handleUserCommand(client string, command string, params []strin
 			reason = fmt.Sprintf("%s: %s", reason, strings.Join(params[2:], " "))
 		}
 		s.partChannel(ch.identifier, rcl.identifier, reason)
+		s.audit(cl, ch.identifier, COMMAND_KICK, params[1], strings.Join(params[2:], " "))
 		cl.sendMessage(fmt.Sprintf("Kicked %s %s", params[0], params[1]))
 	case COMMAND_BAN, COMMAND_KILL:
 		if len(params) < 3 {
@@ -1114,15 +1474,48 @@ func (s *Server) handleUserCommand(client string, command string, params []strin
 		if command == COMMAND_KILL {
 			bch = CHANNEL_SERVER
 		}
-		err := s.ban(bch, rcl.iphash, rcl.account, expires, reason)
+		err := s.ban(bch, rcl.iphash, rcl.account, cl.account, expires, reason)
 		if err != nil {
 			cl.sendError(fmt.Sprintf("Unable to %s, %v", strings.ToLower(command), err))
 			return
 		}
 
-		cl.sendMessage(fmt.Sprintf("%sed %s %s", strings.Title(strings.ToLower(command)), params[0], params[1]))
+		s.audit(cl, ch.identifier, command, params[1], strings.Join(params[2:], " "))
+		action := "Banned"
+		if command == COMMAND_KILL {
+			action = "Killed"
+		}
+		cl.sendMessage(fmt.Sprintf("%s %s %s", action, params[0], params[1]))
+	case COMMAND_UNBAN:
+		if len(params) < 2 {
+			s.sendUsage(cl, command)
+			return
+		}
+
+		banid, err := strconv.ParseInt(params[1], 10, 64)
+		if err != nil || banid <= 0 {
+			cl.sendError("Unable to unban, invalid ban id specified")
+			return
+		}
+
+		err = s.store.DeleteBan(params[0], banid)
+		if err == ErrBanDoesNotExist {
+			cl.sendError("Unable to unban, invalid ban id specified")
+			return
+		} else if err != nil {
+			log.Panicf("%+v", err)
+		}
+
+		s.audit(cl, params[0], COMMAND_UNBAN, params[1], "")
+		cl.sendMessage(fmt.Sprintf("Unbanned %s %s", params[0], params[1]))
 	case COMMAND_STATS:
 		cl.sendMessage(fmt.Sprintf("%d clients in %d channels", s.clientCount(), s.channelCount()))
+		for _, lockout := range s.auth.lockouts() {
+			cl.sendMessage(lockout)
+		}
+		for _, throttled := range s.connections.throttled(s.config.ConnectionLimit, s.config.ConnectionRate, s.connectionWindow()) {
+			cl.sendMessage(throttled)
+		}
 	case COMMAND_REHASH:
 
 		err := s.reload()
@@ -1132,17 +1525,43 @@ func (s *Server) handleUserCommand(client string, command string, params []strin
 			cl.sendMessage("Reloaded configuration")
 		}
 	case COMMAND_UPGRADE:
-		// TODO
+		if _, memory := s.store.(*MemoryStore); memory {
+			cl.sendError(ErrUpgradeMemoryStore.Error())
+			return
+		}
+		cl.sendMessage("Upgrading server...")
+
+		// Upgrade once this client has stopped reading
+		go func() {
+			err := s.upgrade()
+			if err != nil {
+				log.Printf("%+v", err)
+				cl.sendError(err.Error())
+			}
+		}()
 	}
 }
 
-func (s *Server) handlePrivmsg(target string, client string, message string) {
+func (s *Server) handlePrivmsg(command string, target string, client string, message string) {
 	cl := s.getClient(client)
 	if cl == nil || len(target) == 0 {
 		return
 	}
 
+	ctcptag, ctcpmessage, isctcp := ctcp.Decode(message)
+	if !isctcp {
+		// Strip stray CTCP delimiters which some clients would otherwise interpret
+		message = strings.Replace(message, "\x01", "", -1)
+	}
+
 	if strings.ToLower(target) == "anonirc" {
+		if command == irc.NOTICE {
+			return
+		} else if isctcp {
+			s.answerCTCP(cl, &prefixAnonIRC, ctcptag, ctcpmessage)
+			return
+		}
+
 		params := strings.Split(message, " ")
 		if len(params) == 0 || len(params[0]) == 0 {
 			return
@@ -1171,21 +1590,94 @@ func (s *Server) handlePrivmsg(target string, client string, message string) {
 		return
 	}
 
+	logmessage := message
+	if isctcp {
+		if ch.hasMode("C") {
+			cl.writeMessage(irc.ERR_CANNOTSENDTOCHAN, []string{target, fmt.Sprintf("CTCP messages are not allowed (%s)", target)})
+			return
+		} else if ctcptag != ctcp.ACTION {
+			// CTCP replies are dropped, requests are answered by the server to avoid revealing client details
+			if command == irc.PRIVMSG {
+				s.answerCTCP(cl, &prefixAnonymous, ctcptag, ctcpmessage)
+			}
+			return
+		}
+
+		message = ctcp.Action(ctcpmessage)
+		logmessage = "* " + ctcpmessage
+	}
+
 	s.updateClientCount(target, "", "")
 	ch.clients.Range(func(k, v interface{}) bool {
 		chcl := s.getClient(k.(string))
 		if chcl != nil && chcl.identifier != client {
-			chcl.write(&prefixAnonymous, irc.PRIVMSG, []string{target, message})
+			chcl.write(&prefixAnonymous, command, []string{target, message})
 		}
 
 		return true
 	})
-	ch.Log(cl, "CHAT", message)
+
+	logaction := "CHAT"
+	if command == irc.NOTICE {
+		logaction = irc.NOTICE
+	}
+	ch.Log(cl, logaction, logmessage)
+}
+
+func (s *Server) answerCTCP(c *Client, prefix *irc.Prefix, tag string, message string) {
+	var reply string
+	switch tag {
+	case ctcp.VERSION:
+		reply = "AnonIRCd https://github.com/sageru-6ch/anonircd"
+	case ctcp.PING:
+		reply = message
+	case ctcp.TIME:
+		reply = time.Now().UTC().Format(time.RFC1123Z)
+	case ctcp.CLIENTINFO:
+		reply = strings.Join([]string{ctcp.ACTION, ctcp.CLIENTINFO, ctcp.PING, ctcp.TIME, ctcp.VERSION}, " ")
+	default:
+		return // DCC and remaining CTCP requests are dropped
+	}
+
+	c.write(prefix, irc.NOTICE, []string{c.nick, ctcp.Encode(tag, reply)})
+}
+
+// Complete client registration once USER has been received and capability negotiation has ended
+func (s *Server) welcomeClient(c *Client) {
+	if c.welcomed || c.user == "" || c.negotiating {
+		return
+	} else if !s.acceptLimited(c) {
+		return
+	}
+	c.welcomed = true
+
+	c.writeMessage(irc.RPL_WELCOME, []string{"Welcome to AnonIRC " + c.getPrefix().String()})
+	c.writeMessage(irc.RPL_YOURHOST, []string{"Your host is AnonIRC, running version AnonIRCd https://github.com/sageru-6ch/anonircd"})
+	c.writeMessage(irc.RPL_CREATED, []string{fmt.Sprintf("This server was created %s", time.Unix(s.created, 0).UTC())})
+	c.writeMessage(strings.Join([]string{irc.RPL_MYINFO, c.nick, "AnonIRC", "AnonIRCd", CLIENT_MODES, CHANNEL_MODES, CHANNEL_MODES_ARG}, " "), []string{})
+	s.sendISupport(c, s.isupportTokens())
+
+	for i, motdmsg := range s.motd {
+		var motdcode string
+		if i == 0 {
+			motdcode = irc.RPL_MOTDSTART
+		} else if i < len(s.motd)-1 {
+			motdcode = irc.RPL_MOTD
+		} else {
+			motdcode = irc.RPL_ENDOFMOTD
+		}
+		c.writeMessage(motdcode, []string{"  " + motdmsg})
+	}
+
+	s.joinChannel(c.identifier, CHANNEL_LOBBY, "")
+	if c.globalPermission() >= PERMISSION_VIP {
+		s.joinChannel(c.identifier, CHANNEL_SERVER, "")
+	}
 }
 
 func (s *Server) handleRead(c *Client) {
 	for {
-		if c.state == ENTITY_STATE_TERMINATING {
+		if c.terminating() {
 			return
 		}
 
@@ -1194,10 +1686,20 @@ func (s *Server) handleRead(c *Client) {
 			return
 		}
 
-		c.conn.SetReadDeadline(time.Now().Add(300 * time.Second))
-		msg, err := c.reader.Decode()
-		if c.state == ENTITY_STATE_TERMINATING {
+		deadline := time.Now().Add(300 * time.Second)
+		if c.limited != nil {
+			deadline = time.Unix(c.created, 0).Add(CONNECTION_EXEMPT_TIMEOUT)
+		}
+		c.conn.SetReadDeadline(deadline)
+		if s.upgradeInProgress() {
+			return
+		}
+
+		msg, err := c.readMessage()
+		if c.terminating() {
 			return
+		} else if err != nil && s.upgradeInProgress() {
+			return // Reading was interrupted to upgrade the server
 		} else if msg == nil || err != nil {
 			// Error decoding message, client probably disconnected
 			s.killClient(c, "")
@@ -1208,62 +1710,49 @@ func (s *Server) handleRead(c *Client) {
 			log.Printf("%s -> %s", c.identifier, msg)
 		}
 
+		if !s.throttle(c, msg) {
+			return
+		}
+
 		if msg.Command == irc.NICK && c.nick == "*" && len(msg.Params) > 0 && len(msg.Params[0]) > 0 && msg.Params[0] != "" && msg.Params[0] != "*" {
 			c.nick = strings.Trim(msg.Params[0], "\"")
+			if len(c.nick) > s.config.NickLength {
+				c.nick = c.nick[:s.config.NickLength]
+			}
 		} else if msg.Command == irc.USER && c.user == "" && len(msg.Params) >= 3 && msg.Params[0] != "" && msg.Params[2] != "" {
 			c.user = strings.Trim(msg.Params[0], "\"")
 			c.host = strings.Trim(msg.Params[2], "\"")
 
-			c.writeMessage(irc.RPL_WELCOME, []string{"Welcome to AnonIRC " + c.getPrefix().String()})
-			c.writeMessage(irc.RPL_YOURHOST, []string{"Your host is AnonIRC, running version AnonIRCd https://github.com/sageru-6ch/anonircd"})
-			c.writeMessage(irc.RPL_CREATED, []string{fmt.Sprintf("This server was created %s", time.Unix(s.created, 0).UTC())})
-			c.writeMessage(strings.Join([]string{irc.RPL_MYINFO, c.nick, "AnonIRC", "AnonIRCd", CLIENT_MODES, CHANNEL_MODES, CHANNEL_MODES_ARG}, " "), []string{})
-
-			for i, motdmsg := range s.motd {
-				var motdcode string
-				if i == 0 {
-					motdcode = irc.RPL_MOTDSTART
-				} else if i < len(s.motd)-1 {
-					motdcode = irc.RPL_MOTD
-				} else {
-					motdcode = irc.RPL_ENDOFMOTD
-				}
-				c.writeMessage(motdcode, []string{"  " + motdmsg})
-			}
-
-			s.joinChannel(c.identifier, CHANNEL_LOBBY, "")
-			if c.globalPermission() >= PERMISSION_VIP {
-				s.joinChannel(c.identifier, CHANNEL_SERVER, "")
-			}
+			s.welcomeClient(c)
 		} else if msg.Command == irc.PASS && c.user == "" && len(msg.Params) > 0 && len(msg.Params[0]) > 0 {
-			// TODO: Add auth and multiple failed attempts ban
 			authSuccess := false
+			var err error
 			psplit := strings.SplitN(msg.Params[0], ":", 2)
 			if len(psplit) == 2 {
-				authSuccess = c.identify(psplit[0], psplit[1])
+				authSuccess, err = s.identify(c, psplit[0], psplit[1])
 			}
 
 			if !authSuccess {
+				reason := ""
+				if err != nil {
+					reason = "Failed to identify, " + err.Error()
+				}
 				c.sendPasswordIncorrect()
-				s.killClient(c, "")
-			}
-		} else if msg.Command == irc.CAP && len(msg.Params) > 0 && len(msg.Params[0]) > 0 && msg.Params[0] == irc.CAP_LS {
-			c.writeMessage(irc.CAP, []string{irc.CAP_LS, "userhost-in-names"})
-		} else if msg.Command == irc.CAP && len(msg.Params) > 0 && len(msg.Params[0]) > 0 && msg.Params[0] == irc.CAP_REQ {
-			if strings.Contains(msg.Trailing(), "userhost-in-names") {
-				c.capHostInNames = true
+				s.killClient(c, reason)
 			}
-			c.writeMessage(irc.CAP, []string{irc.CAP_ACK, msg.Trailing()})
-		} else if msg.Command == irc.CAP && len(msg.Params) > 0 && len(msg.Params[0]) > 0 && msg.Params[0] == irc.CAP_LIST {
-			caps := []string{}
-			if c.capHostInNames {
-				caps = append(caps, "userhost-in-names")
-			}
-			c.writeMessage(irc.CAP, []string{irc.CAP_LIST, strings.Join(caps, " ")})
+		} else if msg.Command == irc.CAP {
+			s.handleCap(c, msg.Params)
+		} else if msg.Command == irc.AUTHENTICATE {
+			s.handleAuthenticate(c, msg.Params)
 		} else if msg.Command == irc.PING {
 			c.writeMessage(irc.PONG+" AnonIRC", []string{msg.Trailing()})
-		} else if c.user == "" {
-			return // Client must send USER before issuing remaining commands
+		} else if msg.Command == irc.PONG {
+			// Replies to keepalive pings only extend the read deadline
+		} else if msg.Command == irc.QUIT {
+			s.killClient(c, "")
+		} else if !c.welcomed {
+			// Client must complete registration before issuing remaining commands
+			c.writeMessage(irc.ERR_NOTREGISTERED, []string{"You have not registered"})
 		} else if msg.Command == irc.WHOIS && len(msg.Params) > 0 && len(msg.Params[0]) >= len(prefixAnonymous.Name) && strings.ToLower(msg.Params[0][:len(prefixAnonymous.Name)]) == strings.ToLower(prefixAnonymous.Name) {
 			go func() {
 				whoisindex := 1
@@ -1305,7 +1794,7 @@ func (s *Server) handleRead(c *Client) {
 					return true
 				}
 
-				if ch == nil || ch.hasMode("p") || ch.hasMode("s") {
+				if ch == nil || ch.hasMode("p") || ch.hasMode("s") || ch.clientCount() == 0 {
 					return true
 				}
 
@@ -1358,14 +1847,12 @@ func (s *Server) handleRead(c *Client) {
 			} else {
 				s.handleTopic(msg.Params[0], c.identifier, strings.Join(msg.Params[1:], " "))
 			}
-		} else if msg.Command == irc.PRIVMSG && len(msg.Params) > 0 && len(msg.Params[0]) > 0 {
-			s.handlePrivmsg(msg.Params[0], c.identifier, msg.Trailing())
+		} else if (msg.Command == irc.PRIVMSG || msg.Command == irc.NOTICE) && len(msg.Params) > 0 && len(msg.Params[0]) > 0 {
+			s.handlePrivmsg(msg.Command, msg.Params[0], c.identifier, msg.Trailing())
 		} else if msg.Command == irc.PART && len(msg.Params) > 0 && len(msg.Params[0]) > 0 {
 			for _, channel := range strings.Split(msg.Params[0], ",") {
 				s.partChannel(channel, c.identifier, "")
 			}
-		} else if msg.Command == irc.QUIT {
-			s.killClient(c, "")
 		} else {
 			s.handleUserCommand(c.identifier, msg.Command, msg.Params)
 		}
@@ -1381,21 +1868,15 @@ func (s *Server) handleWrite(c *Client) {
 			continue
 		}
 
-		addnick := false
-		if _, err := strconv.Atoi(msg.Command); err == nil {
-			addnick = true
-		} else if msg.Command == irc.CAP {
-			addnick = true
-		}
-
-		if addnick {
-			msg.Params = append([]string{c.nick}, msg.Params...)
-		}
-
 		if debugMode && (verbose || len(msg.Command) < 4 || (msg.Command[0:4] != irc.PING && msg.Command[0:4] != irc.PONG)) {
 			log.Printf("%s <- %s", c.identifier, msg)
 		}
-		err := c.writer.Encode(msg)
+		var err error
+		if tags := s.messageTags(c, msg); tags != "" {
+			_, err = c.writer.Write(append([]byte("@"+tags+" "), msg.Bytes()...))
+		} else {
+			err = c.writer.Encode(msg.Message)
+		}
 		if err != nil {
 			werror = true
 		}
@@ -1415,30 +1896,63 @@ func (s *Server) handleConnection(conn net.Conn, ssl bool) {
 		}
 	}
 
-	c := NewClient(identifier, conn, ssl)
-	banned := true
-	reason := ""
-	if c != nil {
-		banned, reason = c.isBanned(CHANNEL_SERVER)
+	iphash, err := addressHash(conn)
+	if err != nil {
+		return
+	}
+
+	// Connections exceeding limits are only accepted when the client identifies to an exempt account while registering
+	limited := s.connections.connect(iphash, s.config.ConnectionLimit, s.config.ConnectionRate, s.connectionWindow())
+	if limited != nil && len(s.config.ConnectionExempt) == 0 {
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		irc.NewEncoder(conn).Encode(&irc.Message{Command: irc.ERROR, Params: []string{"Closing Link: " + limited.Error()}})
+		return
+	}
+
+	c := NewClient(identifier, conn, ssl, s.store)
+	if c == nil {
+		return
+	}
+	c.limited = limited
+	defer func() {
+		if c.limited == nil {
+			s.connections.disconnect(c.iphash)
+		}
+	}()
+
+	if banned, reason := c.isBanned(CHANNEL_SERVER); banned {
+		go s.handleWrite(c)
+		c.sendBanned(reason)
+		s.killClient(c, "")
+		return
+	} else if s.upgradeInProgress() {
+		return // Connection was accepted before listeners were stopped
 	}
 
+	s.serveClient(c)
+}
+
+func (s *Server) serveClient(c *Client) {
+	defer c.conn.Close()
+
 	go s.handleWrite(c)
-	if !banned {
-		s.clients.Store(c.identifier, c)
+	s.clients.Store(c.identifier, c)
+
+	for {
 		s.handleRead(c) // Block until the connection is closed
-	} else {
-		c.sendBanned(reason)
+		if c.terminating() || !s.waitUpgrade(c) {
+			break
+		}
 	}
 
 	s.killClient(c, "")
-	s.clients.Delete(identifier)
+	s.clients.Delete(c.identifier)
 }
 
 func (s *Server) killClient(c *Client, reason string) {
-	if c == nil || c.state == ENTITY_STATE_TERMINATING {
+	if c == nil || !c.terminate() {
 		return
 	}
-	c.state = ENTITY_STATE_TERMINATING
 
 	if _, ok := s.clients.Load(c.identifier); ok {
 		s.partAllChannels(c.identifier, reason)
@@ -1448,72 +1962,82 @@ func (s *Server) killClient(c *Client, reason string) {
 	c.conn.Close()
 }
 
-func (s *Server) listenPlain() {
-	for {
-		listen, err := net.Listen("tcp", ":6667")
-		if err != nil {
-			log.Printf("Failed to listen: %v", err)
-			time.Sleep(1 * time.Minute)
-			continue
-		}
-		log.Println("Listening on 6667")
+// Stop accepting connections, notify and disconnect all clients, then persist channel state and close the database
+func (s *Server) shutdown() {
+	log.Println("Shutting down...")
 
-	accept:
-		for {
-			select {
-			case <-s.restartplain:
-				break accept
-			default:
-				conn, err := listen.Accept()
-				if err != nil {
-					log.Println("Error accepting connection:", err)
-					continue
-				}
-				go s.handleConnection(conn, false)
-			}
-		}
-		listen.Close()
+	s.Lock()
+	for address, l := range s.listeners {
+		l.Stop()
+		delete(s.listeners, address)
 	}
-}
+	s.Unlock()
 
-func (s *Server) listenSSL() {
-	for {
-		if s.config.SSLCert == "" {
-			time.Sleep(1 * time.Minute)
-			return // SSL is disabled
-		}
+	message := s.config.ShutdownMessage
+	if message == "" {
+		message = DEFAULT_SHUTDOWN_MESSAGE
+	}
 
-		cert, err := tls.LoadX509KeyPair(s.config.SSLCert, s.config.SSLKey)
+	clients := s.getClients("")
+	for _, cl := range clients {
+		cl.conn.SetWriteDeadline(time.Now().Add(SHUTDOWN_TIMEOUT))
+		cl.write(nil, irc.ERROR, []string{"Closing Link: " + message})
+	}
+
+	// Writes fail once the deadline is reached, allowing slow clients to be drained. Reading is only interrupted once the
+	// notice has been written, as clients are terminated when reading fails.
+	for _, cl := range clients {
+		cl.wg.Wait()
+		cl.conn.SetReadDeadline(time.Now())
+		cl.conn.Close()
+	}
+
+	err := s.persistChannels()
+	if err != nil {
+		log.Printf("%+v", err)
+	}
+
+	s.closeDatabase()
+	log.Println("Shut down")
+}
+
+// Write the state of founded channels to the database
+func (s *Server) persistChannels() error {
+	for _, ch := range s.getChannels("") {
+		err := s.persistTopic(ch)
 		if err != nil {
-			log.Printf("Failed to load SSL certificate: %v", err)
-			time.Sleep(1 * time.Minute)
-			continue
+			return err
 		}
 
-		listen, err := tls.Listen("tcp", ":6697", &tls.Config{Certificates: []tls.Certificate{cert}})
+		err = s.persistModes(ch)
 		if err != nil {
-			log.Printf("Failed to listen: %v", err)
-			time.Sleep(1 * time.Minute)
-			continue
+			return err
 		}
-		log.Println("Listening on +6697")
+	}
 
-	accept:
-		for {
-			select {
-			case <-s.restartssl:
-				break accept
-			default:
-				conn, err := listen.Accept()
-				if err != nil {
-					log.Println("Error accepting connection:", err)
-					continue
-				}
-				go s.handleConnection(conn, true)
-			}
-		}
-		listen.Close()
+	return nil
+}
+
+func (s *Server) persistTopic(ch *Channel) error {
+	dbch, err := s.store.Channel(ch.identifier)
+	if err != nil {
+		return err
+	} else if dbch.Channel == "" {
+		return nil // Channel has not been founded
+	}
+
+	return s.store.SetTopic(ch.identifier, ch.topic, ch.topictime)
+}
+
+func (s *Server) persistModes(ch *Channel) error {
+	dbch, err := s.store.Channel(ch.identifier)
+	if err != nil {
+		return err
+	} else if dbch.Channel == "" {
+		return nil // Channel has not been founded
 	}
+
+	return s.store.SetModes(ch.identifier, ch.getModes())
 }
 
 func (s *Server) pingClients() {
@@ -1530,15 +2054,61 @@ func (s *Server) pingClients() {
 	}
 }
 
-func (s *Server) connectDatabase() {
-	err := db.Connect(s.config.DBDriver, s.config.DBSource)
+// Connect to the configured store, the database is reconnected when it was closed to upgrade
+func (s *Server) connectDatabase() error {
+	if s.store == nil {
+		if s.config.DBDriver == DB_DRIVER_MEMORY {
+			log.Println("WARNING: Using an in-memory store, data is lost when the server is stopped and UPGRADE is unavailable")
+			s.store = NewMemoryStore()
+		} else {
+			s.store = &Database{}
+		}
+	}
+
+	if d, ok := s.store.(*Database); ok {
+		err := d.Connect(s.config.DBDriver, s.config.DBSource)
+		if err != nil {
+			return err
+		}
+	}
+
+	var err error
+	s.secret, err = s.store.Secret()
+	if err != nil {
+		return errors.Wrap(err, "failed to load secret")
+	}
+
+	return s.loadConnectionExempt()
+}
+
+func (s *Server) printPendingMigrations() {
+	if s.config.DBDriver == DB_DRIVER_MEMORY {
+		log.Println("In-memory stores are not migrated")
+		return
+	}
+
+	d := &Database{}
+	err := d.Open(s.config.DBDriver, s.config.DBSource)
+	if err != nil {
+		log.Panicf("%+v", err)
+	}
+	defer d.Close()
+
+	pending, err := d.PendingMigrations()
 	if err != nil {
 		log.Panicf("%+v", err)
 	}
+
+	for _, m := range pending {
+		log.Printf("Pending database migration %d: %s", m.Version, m.Description)
+	}
+	if len(pending) == 0 {
+		log.Println("Database is up to date")
+	}
 }
 
 func (s *Server) closeDatabase() {
-	err := db.Close()
+	err := s.store.Close()
 	if err != nil {
 		log.Panicf("%+v", err)
 	}
@@ -1553,36 +2123,91 @@ func (s *Server) loadConfig() error {
 		return errors.New("unable to find configuration file " + s.configfile)
 	}
 
-	oldconfig := &*s.config
-
-	if _, err := toml.DecodeFile(s.configfile, &s.config); err != nil {
-		if oldconfig != nil {
-			s.config = oldconfig
-		}
-
+	// Decode into a new configuration, values omitted from the file must not retain their previous values
+	config := &Config{}
+	if _, err := toml.DecodeFile(s.configfile, config); err != nil {
 		return errors.New(fmt.Sprintf("Failed to read configuration file %s: %v", s.configfile, err))
 	}
 
-	if s.config.DBDriver == "" || s.config.DBSource == "" {
-		if oldconfig != nil {
-			s.config = oldconfig
-		}
-
+	if config.DBDriver == "" || (config.DBSource == "" && config.DBDriver != DB_DRIVER_MEMORY) {
 		return errors.New(fmt.Sprintf("DBDriver and DBSource must be configured in %s\nExample:\n\nDBDriver=\"sqlite3\"\nDBSource=\"/home/user/anonircd/anonircd.db\"", s.configfile))
 	}
 
+	s.applyConfigDefaults(config)
+	s.config = config
+	return nil
+}
+
+// Replace unset configuration values with their defaults
+func (s *Server) applyConfigDefaults(config *Config) {
 	motd := DEFAULT_MOTD
-	if s.config.MOTD != "" {
-		motd = s.config.MOTD
+	if config.MOTD != "" {
+		motd = config.MOTD
 	}
 	s.motd = strings.Split(strings.TrimRight(motd, " \t\r\n"), "\n")
 
-	return nil
+	if config.NickLength <= 0 {
+		config.NickLength = DEFAULT_NICKLEN
+	}
+	if config.TopicLength <= 0 {
+		config.TopicLength = DEFAULT_TOPICLEN
+	}
+	if config.AuthAttempts <= 0 {
+		config.AuthAttempts = DEFAULT_AUTH_ATTEMPTS
+	}
+	if config.AuthLockout <= 0 {
+		config.AuthLockout = DEFAULT_AUTH_LOCKOUT
+	}
+	if config.AuthMaxLockout <= 0 {
+		config.AuthMaxLockout = DEFAULT_AUTH_MAX_LOCKOUT
+	}
+	if config.AuthBanThreshold == 0 {
+		config.AuthBanThreshold = DEFAULT_AUTH_BAN_THRESHOLD
+	}
+	if config.AuthBanDuration <= 0 {
+		config.AuthBanDuration = DEFAULT_AUTH_BAN_DURATION
+	}
+	if config.ChannelLogEntries <= 0 || config.ChannelLogEntries > CHANNEL_LOGS_MAX {
+		config.ChannelLogEntries = CHANNEL_LOGS_MAX
+	}
+	if config.FloodMessageRate == 0 {
+		config.FloodMessageRate = DEFAULT_FLOOD_MESSAGE_RATE
+	}
+	if config.FloodMessageBurst <= 0 {
+		config.FloodMessageBurst = DEFAULT_FLOOD_MESSAGE_BURST
+	}
+	if config.FloodJoinRate == 0 {
+		config.FloodJoinRate = DEFAULT_FLOOD_JOIN_RATE
+	}
+	if config.FloodJoinBurst <= 0 {
+		config.FloodJoinBurst = DEFAULT_FLOOD_JOIN_BURST
+	}
+	if config.FloodCommandRate == 0 {
+		config.FloodCommandRate = DEFAULT_FLOOD_COMMAND_RATE
+	}
+	if config.FloodCommandBurst <= 0 {
+		config.FloodCommandBurst = DEFAULT_FLOOD_COMMAND_BURST
+	}
+	if config.ConnectionLimit == 0 {
+		config.ConnectionLimit = DEFAULT_CONNECTION_LIMIT
+	}
+	if config.ConnectionRate == 0 {
+		config.ConnectionRate = DEFAULT_CONNECTION_RATE
+	}
+	if config.ConnectionWindow <= 0 {
+		config.ConnectionWindow = DEFAULT_CONNECTION_WINDOW
+	}
+	if config.FloodRecvQ == 0 {
+		config.FloodRecvQ = DEFAULT_FLOOD_RECVQ
+	} else if config.FloodRecvQ >= CLIENT_READ_BUFFER {
+		config.FloodRecvQ = CLIENT_READ_BUFFER - 1
+	}
 }
 
 func (s *Server) reload() error {
 	log.Println("Reloading configuration...")
 
+	lasttokens := s.isupportTokens()
 	err := s.loadConfig()
 	if err != nil {
 		log.Println("Failed to reload configuration")
@@ -1590,15 +2215,26 @@ func (s *Server) reload() error {
 	}
 	log.Println("Reloaded configuration")
 
-	s.restartplain <- true
-	s.restartssl <- true
+	err = s.loadConnectionExempt()
+	if err != nil {
+		return errors.Wrap(err, "failed to load connection exemptions")
+	}
+
+	s.updateISupport(lasttokens)
+
+	for _, ch := range s.getChannels("") {
+		s.setLogLimits(ch)
+	}
+
+	s.updateListeners()
 
 	return nil
 }
 
 func (s *Server) listen() {
-	go s.listenPlain()
-	go s.listenSSL()
+	s.updateListeners()
+
+	go s.sweepBans()
 
 	s.pingClients()
 }
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Create a server using an in-memory store
+func newTestServer(t *testing.T) *Server {
+	s := NewServer("")
+	s.config.DBDriver = DB_DRIVER_MEMORY
+	s.applyConfigDefaults(s.config)
+	require.NoError(t, s.connectDatabase())
+
+	return s
+}
+
+// Create an account, returning its ID
+func addTestAccount(t *testing.T, s *Server, username string) int64 {
+	require.NoError(t, s.store.AddAccount(username, "password"))
+	a, err := s.store.AccountU(username)
+	require.NoError(t, err)
+
+	return a.ID
+}
+
+// Client connected to a test server over a loopback connection
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Accept a single connection to the server, optionally using TLS, returning the address to connect to
+func listenTestServer(t *testing.T, s *Server, tlsconfig *tls.Config) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		conn, err := l.Accept()
+		l.Close()
+		if err != nil {
+			return
+		}
+
+		if tlsconfig != nil {
+			conn = tls.Server(conn, tlsconfig)
+		}
+		s.handleConnection(conn, tlsconfig != nil)
+	}()
+
+	return l.Addr().String()
+}
+
+// Wrap a client-side connection to the server
+func newTestClient(t *testing.T, conn net.Conn) *testClient {
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// Connect to the server without registering
+func dialTestClient(t *testing.T, s *Server) *testClient {
+	conn, err := net.Dial("tcp", listenTestServer(t, s, nil))
+	require.NoError(t, err)
+
+	return newTestClient(t, conn)
+}
+
+// Connect and register using the specified nick, returning once the server has welcomed the client
+func connectTestClient(t *testing.T, s *Server, nick string) *testClient {
+	c := dialTestClient(t, s)
+	c.send("NICK "+nick, "USER "+nick+" 0 * :"+nick)
+	c.expect(" 001 ")
+
+	return c
+}
+
+func (c *testClient) send(lines ...string) {
+	for _, line := range lines {
+		_, err := c.conn.Write([]byte(line + "\r\n"))
+		require.NoError(c.t, err)
+	}
+}
+
+// Read lines until one contains the expected text
+func (c *testClient) expect(expected string) string {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := c.r.ReadString('\n')
+		require.NoError(c.t, err, "expected %q", expected)
+
+		if strings.Contains(line, expected) {
+			return line
+		}
+	}
+}
+
+// Read lines until the server closes the connection
+func (c *testClient) expectClosed() {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, err := c.r.ReadString('\n')
+		if err != nil {
+			netErr, timeout := err.(net.Error)
+			require.False(c.t, timeout && netErr.Timeout(), "connection was not closed")
+			return
+		}
+	}
+}
+
+func (c *testClient) Close() {
+	c.conn.Close()
+}
+
+func TestServerShutdown(t *testing.T) {
+	s := newTestServer(t)
+	s.config.ShutdownMessage = "Maintenance"
+
+	c := connectTestClient(t, s, "test")
+	defer c.Close()
+	assert.Equal(t, 1, s.clientCount())
+
+	s.shutdown()
+
+	assert.Equal(t, "ERROR :Closing Link: Maintenance\r\n", c.expect("ERROR"))
+	c.expectClosed()
+}
+
+func TestUpgradeMemoryStore(t *testing.T) {
+	s := newTestServer(t)
+
+	assert.Equal(t, ErrUpgradeMemoryStore, s.upgrade())
+	assert.False(t, s.upgradeInProgress())
+}
+
+func TestRehash(t *testing.T) {
+	f, err := ioutil.TempFile("", "anonircd-config")
+	require.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	writeConfig := func(config string) {
+		require.NoError(t, ioutil.WriteFile(f.Name(), []byte("DBDriver = \"memory\"\n"+config), 0600))
+	}
+
+	s := NewServer(f.Name())
+	writeConfig(`
+MOTD = "Hello"
+NickLength = 12
+
+[[listener]]
+Label = "plain"
+Address = "127.0.0.1"
+Port = 7000
+
+[[listener]]
+Address = "127.0.0.1"
+Port = 7001
+SSL = true
+`)
+	require.NoError(t, s.loadConfig())
+	assert.Equal(t, []string{"Hello"}, s.motd)
+	assert.Equal(t, 12, s.config.NickLength)
+	assert.Len(t, s.listenerConfigs(), 2)
+
+	// Values removed from the configuration are reset to their defaults
+	writeConfig(`
+[[listener]]
+Address = "127.0.0.1"
+`)
+	require.NoError(t, s.loadConfig())
+	assert.Equal(t, DEFAULT_NICKLEN, s.config.NickLength)
+	assert.Equal(t, map[string]ListenerConfig{"127.0.0.1:6667": {Address: "127.0.0.1", Port: DEFAULT_PORT}}, s.listenerConfigs())
+
+	writeConfig("")
+	require.NoError(t, s.loadConfig())
+	assert.Equal(t, map[string]ListenerConfig{":6667": {Port: DEFAULT_PORT}}, s.listenerConfigs())
+
+	// Invalid configurations are not applied
+	config := s.config
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte("NickLength = 5\n"), 0600))
+	require.Error(t, s.loadConfig())
+	assert.True(t, config == s.config)
+	assert.Equal(t, DEFAULT_NICKLEN, s.config.NickLength)
+
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte("DBDriver = \"memory\"\nNickLength = \"five\"\n"), 0600))
+	require.Error(t, s.loadConfig())
+	assert.Equal(t, DEFAULT_NICKLEN, s.config.NickLength)
+}
+
+func TestChannelMessages(t *testing.T) {
+	s := newTestServer(t)
+
+	sender := connectTestClient(t, s, "sender")
+	defer sender.Close()
+	receiver := connectTestClient(t, s, "receiver")
+	defer receiver.Close()
+
+	sender.send("JOIN #messages")
+	sender.expect(" JOIN #messages")
+	receiver.send("JOIN #messages", "PING :joined")
+	receiver.expect("PONG AnonIRC joined")
+
+	sender.send("NOTICE #messages :A notice")
+	assert.Contains(t, receiver.expect(" #messages "), " NOTICE #messages :A notice\r\n")
+
+	// Stray CTCP delimiters are stripped
+	sender.send("PRIVMSG #messages :Stray\x01 delimiter")
+	assert.Contains(t, receiver.expect(" #messages "), " PRIVMSG #messages :Stray delimiter\r\n")
+
+	sender.send("PRIVMSG #messages :\x01ACTION waves\x01")
+	assert.Contains(t, receiver.expect(" #messages "), " PRIVMSG #messages :\x01ACTION waves\x01\r\n")
+
+	// CTCP requests are answered by the server, CTCP replies are dropped
+	sender.send("PRIVMSG #messages :\x01VERSION\x01", "NOTICE #messages :\x01VERSION Client\x01", "PRIVMSG #messages :\x01DCC SEND file 0 0 0\x01")
+	assert.Contains(t, sender.expect(" NOTICE sender :"), ":\x01VERSION AnonIRCd")
+	sender.send("PRIVMSG #messages :Relayed message")
+	assert.Contains(t, receiver.expect(" #messages "), " PRIVMSG #messages :Relayed message\r\n")
+
+	s.getChannel("#messages").addMode("C", "")
+	sender.send("PRIVMSG #messages :\x01ACTION waves\x01")
+	sender.expect("CTCP messages are not allowed")
+	sender.send("NOTICE #messages :Relayed message")
+	assert.Contains(t, receiver.expect(" #messages "), " NOTICE #messages :Relayed message\r\n")
+}
+
+func TestFoundDrop(t *testing.T) {
+	s := newTestServer(t)
+	s.config.FloodCommandBurst = 20
+	accountid := addTestAccount(t, s, "founder")
+
+	c := connectTestClient(t, s, "test")
+	defer c.Close()
+
+	c.send("IDENTIFY founder password")
+	c.expect("Identified successfully")
+
+	c.send("FOUND #found")
+	c.expect("Unable to found, you are not in that channel")
+
+	c.send("JOIN #found", "TOPIC #found :Founded", "PING :joined")
+	c.expect("PONG AnonIRC joined")
+	s.getChannel("#found").addMode("C", "")
+	c.send("FOUND #found")
+	c.expect("Founded #found")
+	c.send("FOUND #found")
+	c.expect("Unable to found, channel has already been founded")
+
+	// The founder is granted superadmin, the topic and modes are persisted
+	dbch, err := s.store.Channel("#found")
+	require.NoError(t, err)
+	assert.Equal(t, "Founded", dbch.Topic)
+	modes, err := s.store.Modes("#found")
+	require.NoError(t, err)
+	require.Len(t, modes, 1)
+	assert.Equal(t, "C", modes[0].Mode)
+	p, err := s.store.GetPermission(accountid, "#found")
+	require.NoError(t, err)
+	assert.Equal(t, PERMISSION_SUPERADMIN, p.Permission)
+
+	// Channels may be dropped by their founder using a matching confirmation
+	other := connectTestClient(t, s, "other")
+	defer other.Close()
+	other.send("JOIN #found", "DROP #found #found")
+	other.expect("Access denied")
+
+	c.send("DROP #found #other")
+	c.expect("Unable to drop, channels don't match")
+	c.send("DROP #found #FOUND")
+	c.expect("Dropped #found")
+
+	c.send("IDENTIFY admin password")
+	c.expect("Identified successfully")
+	c.send("DROP # #")
+	c.expect("Unable to drop, server channels may not be dropped")
+	c.send("DROP #found #found")
+	c.expect("Unable to drop, channel is not founded")
+
+	dbch, err = s.store.Channel("#found")
+	require.NoError(t, err)
+	assert.Empty(t, dbch.Channel)
+	modes, err = s.store.Modes("#found")
+	require.NoError(t, err)
+	assert.Empty(t, modes)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/base64"
+
+	"github.com/gorilla/securecookie"
+	"github.com/pkg/errors"
+)
+
+// Data is kept in memory instead of a database when DBDriver is set to this value
+const DB_DRIVER_MEMORY = "memory"
+
+// Store persists accounts, channels, permissions, bans and other server data. Channels, usernames and other
+// identifying values are hashed before they are stored.
+type Store interface {
+	Close() error
+
+	// Random value used to derive identifiers which must not be reversible
+	Secret() (string, error)
+
+	Account(id int64) (DBAccount, error)
+	AccountU(username string) (DBAccount, error)
+	Auth(username string, password string) (int64, error)
+	AddAccount(username string, password string) error
+	SetUsername(accountid int64, username string, password string) error
+	SetPassword(accountid int64, password string) error
+
+	AddToken(accountid int64, channel string, expires int64) (string, error)
+	TokenAccount(channel string, token string) (int64, error)
+
+	CertificateAccount(fingerprint string) (int64, error)
+	AddCertificate(accountid int64, fingerprint string) error
+	DeleteCertificate(accountid int64, fingerprint string) error
+
+	Channel(channel string) (DBChannel, error)
+	AddChannel(accountid int64, channel *DBChannel) error
+	DropChannel(channel string) error
+	SetTopic(channel string, topic string, topictime int64) error
+
+	Modes(channel string) ([]DBMode, error)
+	SetMode(channel string, mode string, value string) error
+	SetModes(channel string, modes map[string]string) error
+	DeleteMode(channel string, mode string) error
+
+	GetPermission(accountid int64, channel string) (DBPermission, error)
+	Permissions(channel string) ([]DBPermission, error)
+	SetPermission(accountid int64, channel string, permission int) error
+	DeletePermission(accountid int64, channel string) error
+
+	Ban(banid int64) (DBBan, error)
+	BanAddr(addrhash string, channel string) (DBBan, error)
+	BanAccount(accountid int64, channel string) (DBBan, error)
+	Bans(channel string, offset int, limit int) ([]DBBan, error)
+	AddBan(b DBBan) error
+	DeleteBan(channel string, banid int64) error
+	DeleteExpiredBans() (int64, error)
+
+	Audit(channel string, offset int, limit int) ([]DBAudit, error)
+	AddAudit(a DBAudit) error
+}
+
+var _ Store = &Database{}
+var _ Store = &MemoryStore{}
+
+// Create the administrator account and default channels when they don't exist
+func initializeStore(st Store) error {
+	a, err := st.Account(1)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize")
+	}
+
+	if a.ID > 0 {
+		return nil // Admin account exists
+	}
+
+	err = st.AddAccount("admin", "password")
+	if err != nil {
+		return errors.Wrap(err, "failed to create initial administrator account")
+	}
+
+	ac := &DBChannel{Channel: CHANNEL_SERVER, Topic: "Secret Area of VIP Quality"}
+	st.AddChannel(1, ac)
+
+	uc := &DBChannel{Channel: CHANNEL_LOBBY, Topic: "Welcome to AnonIRC"}
+	st.AddChannel(1, uc)
+
+	return nil
+}
+
+// Verify a username and password, rehashing the password when it was hashed using outdated parameters
+func authenticateAccount(st Store, username string, password string) (int64, error) {
+	a, err := st.AccountU(username)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to authenticate account")
+	} else if a.ID == 0 {
+		// Hash the password anyway to avoid revealing whether the account exists
+		hashPassword(password, "", passwordParams)
+		return 0, nil
+	}
+
+	ok, err := verifyPassword(a, username, password)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to authenticate account")
+	} else if !ok {
+		return 0, nil
+	}
+
+	if a.Params != passwordParams.String() {
+		err = st.SetPassword(a.ID, password)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to rehash password")
+		}
+	}
+
+	return a.ID, nil
+}
+
+// Bounds of a page of results, limit may be -1 to include all remaining results
+func paginate(length int, offset int, limit int) (int, int) {
+	if offset > length {
+		offset = length
+	}
+
+	end := length
+	if limit >= 0 && offset+limit < end {
+		end = offset + limit
+	}
+
+	return offset, end
+}
+
+func generateToken() string {
+	return base64.URLEncoding.EncodeToString(securecookie.GenerateRandomKey(64))
+}
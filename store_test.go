@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestDatabaseStore(t *testing.T) {
+	d, cleanup := testDatabase(t, "")
+	defer cleanup()
+
+	require.NoError(t, d.Migrate())
+	require.NoError(t, d.CreateTables())
+	require.NoError(t, d.Initialize())
+
+	testStore(t, d)
+}
+
+// Verify the behavior shared by all Store implementations
+func testStore(t *testing.T, st Store) {
+	// Initialized with the administrator account and default channels
+	accountid, err := st.Auth("admin", "password")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), accountid)
+
+	dbch, err := st.Channel(CHANNEL_LOBBY)
+	require.NoError(t, err)
+	assert.Equal(t, "Welcome to AnonIRC", dbch.Topic)
+
+	// Accounts
+	require.NoError(t, st.AddAccount("bob", "hunter2"))
+	assert.Equal(t, ErrAccountExists, st.AddAccount("bob", "other"))
+
+	bob, err := st.AccountU("bob")
+	require.NoError(t, err)
+	require.NotZero(t, bob.ID)
+
+	accountid, err = st.Auth("bob", "wrong")
+	require.NoError(t, err)
+	assert.Zero(t, accountid)
+
+	require.NoError(t, st.SetUsername(bob.ID, "robert", "hunter3"))
+	accountid, err = st.Auth("robert", "hunter3")
+	require.NoError(t, err)
+	assert.Equal(t, bob.ID, accountid)
+
+	// Channels and permissions
+	require.NoError(t, st.AddChannel(bob.ID, &DBChannel{Channel: "#Test", Topic: "Testing"}))
+	assert.Equal(t, ErrChannelExists, st.AddChannel(1, &DBChannel{Channel: "#test"}))
+
+	p, err := st.GetPermission(bob.ID, "#TEST")
+	require.NoError(t, err)
+	assert.Equal(t, PERMISSION_SUPERADMIN, p.Permission)
+
+	require.NoError(t, st.SetPermission(1, "#test", PERMISSION_VIP))
+	permissions, err := st.Permissions("#test")
+	require.NoError(t, err)
+	require.Len(t, permissions, 2)
+	assert.Equal(t, bob.ID, permissions[0].Account)
+	assert.Equal(t, PERMISSION_VIP, permissions[1].Permission)
+
+	require.NoError(t, st.DeletePermission(1, "#test"))
+	p, err = st.GetPermission(1, "#test")
+	require.NoError(t, err)
+	assert.Equal(t, PERMISSION_REGISTERED, p.Permission)
+
+	require.NoError(t, st.SetMode("#test", "k", "secret"))
+	modes, err := st.Modes("#test")
+	require.NoError(t, err)
+	require.Len(t, modes, 1)
+	assert.Equal(t, "secret", modes[0].Value)
+
+	// Tokens
+	token, err := st.AddToken(1, "#test", time.Now().Add(time.Hour).Unix())
+	require.NoError(t, err)
+	accountid, err = st.TokenAccount("#test", token)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), accountid)
+	accountid, err = st.TokenAccount("#other", token)
+	require.NoError(t, err)
+	assert.Zero(t, accountid)
+
+	// Bans
+	now := time.Now().Unix()
+	require.NoError(t, st.AddBan(DBBan{Channel: "#test", Type: BAN_TYPE_ADDRESS, Target: "addr", Reason: "Spamming", Created: now}))
+	require.NoError(t, st.AddBan(DBBan{Channel: "#test", Type: BAN_TYPE_ACCOUNT, Target: "1", Expires: now + 3600, Created: now}))
+	require.NoError(t, st.AddBan(DBBan{Channel: "#test", Type: BAN_TYPE_ADDRESS, Target: "expired", Expires: now - 1, Created: now}))
+
+	b, err := st.BanAddr("addr", "#TEST")
+	require.NoError(t, err)
+	assert.Equal(t, "Spamming", b.Reason)
+	b, err = st.BanAccount(1, "#test")
+	require.NoError(t, err)
+	assert.NotZero(t, b.ID)
+	b, err = st.BanAddr("expired", "#test")
+	require.NoError(t, err)
+	assert.Zero(t, b.ID)
+
+	bans, err := st.Bans("#test", 1, 1)
+	require.NoError(t, err)
+	require.Len(t, bans, 1)
+	assert.Equal(t, BAN_TYPE_ACCOUNT, bans[0].Type)
+
+	deleted, err := st.DeleteExpiredBans()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	assert.Equal(t, ErrBanDoesNotExist, st.DeleteBan("#other", bans[0].ID))
+	require.NoError(t, st.DeleteBan("#test", bans[0].ID))
+
+	// Audit
+	require.NoError(t, st.AddAudit(DBAudit{Channel: "#Test", Account: 1, Action: COMMAND_BAN, Time: now}))
+	entries, err := st.Audit("#test", 0, -1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, COMMAND_BAN, entries[0].Action)
+
+	// Dropping a channel deletes its data, including the audit log
+	require.NoError(t, st.DropChannel("#test"))
+	assert.Equal(t, ErrChannelDoesNotExist, st.DropChannel("#test"))
+
+	bans, err = st.Bans("#test", 0, -1)
+	require.NoError(t, err)
+	assert.Empty(t, bans)
+	modes, err = st.Modes("#test")
+	require.NoError(t, err)
+	assert.Empty(t, modes)
+	accountid, err = st.TokenAccount("#test", token)
+	require.NoError(t, err)
+	assert.Zero(t, accountid)
+	entries, err = st.Audit("#test", 0, -1)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,14 @@
+-- Database created by AnonIRCd before the schema version was recorded
+CREATE TABLE `meta` (`key` TEXT NULL PRIMARY KEY,`value` TEXT NULL);
+CREATE TABLE `accounts` (`id` INTEGER PRIMARY KEY AUTOINCREMENT,`username` TEXT NULL,`password` TEXT NULL);
+CREATE TABLE `channels` (`channel` TEXT PRIMARY KEY,`topic` TEXT NULL,`topictime` INTEGER NULL,`password` TEXT NULL);
+CREATE TABLE `permissions` (`channel` TEXT NULL,`account` INTEGER NULL,`permission` INTEGER NULL);
+CREATE TABLE `bans` (`channel` TEXT NULL,`type` INTEGER NULL,`target` TEXT NULL,`expires` INTEGER NULL,`reason` TEXT NULL);
+INSERT INTO accounts (username, password) VALUES ('xN-gZDJ8ayE-E6Sw294vOt1-y2b60I8TxdPjF9QYNT8Ns-sHTQRgkFSGqTvA7VY-zDQ82Ub3kmFYr-LH5Keu7A==', 'c92EDa9599UiH1wWS8eKyLJnXaO6iovBM7ko7Lcd0dqia5AfMf0QWJm9zh64Vgef91KqGZBn9f32eljc0l9_3w==');
+INSERT INTO channels (channel, topic, topictime, password) VALUES ('T27wkcK_v1kF0Ej4c3kvKjBmtp-C_fMxRiVWCQxlBUuTe93xHii-D_LeyQIogK_uufsQ6va28iBQm77_syevTQ==', 'Secret Area of VIP Quality', 0, '');
+INSERT INTO channels (channel, topic, topictime, password) VALUES ('G2lKx1We9jIOfNJgEiscDKUD4GqZw3WvHYtBQXBZr7tiUVhb0LVoYNitHQix1JVr3BWzkMnB3VfykDpDHDm9xg==', 'Welcome to AnonIRC', 0, '');
+INSERT INTO channels (channel, topic, topictime, password) VALUES ('aDwa1qJh08WFYehRit5qmve6v4liZc0joCDCRjkwUgHVbHxoiT5-nW_8KBQqSf7XHTWCzbaPG3C2GYc84Obzew==', 'Keyed channel', 1554120000, 'hunter2');
+INSERT INTO permissions (channel, account, permission) VALUES ('T27wkcK_v1kF0Ej4c3kvKjBmtp-C_fMxRiVWCQxlBUuTe93xHii-D_LeyQIogK_uufsQ6va28iBQm77_syevTQ==', 1, 5);
+INSERT INTO permissions (channel, account, permission) VALUES ('G2lKx1We9jIOfNJgEiscDKUD4GqZw3WvHYtBQXBZr7tiUVhb0LVoYNitHQix1JVr3BWzkMnB3VfykDpDHDm9xg==', 1, 5);
+INSERT INTO permissions (channel, account, permission) VALUES ('aDwa1qJh08WFYehRit5qmve6v4liZc0joCDCRjkwUgHVbHxoiT5-nW_8KBQqSf7XHTWCzbaPG3C2GYc84Obzew==', 1, 5);
+INSERT INTO bans (channel, type, target, expires, reason) VALUES ('aDwa1qJh08WFYehRit5qmve6v4liZc0joCDCRjkwUgHVbHxoiT5-nW_8KBQqSf7XHTWCzbaPG3C2GYc84Obzew==', 2, '2', 0, 'Spamming');
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// Environment variable used to pass the state file path to the upgraded process
+const UPGRADE_ENV = "ANONIRCD_UPGRADE"
+
+// Maximum amount of time to wait for clients to pause and flush pending messages
+const UPGRADE_TIMEOUT = 5 * time.Second
+
+// Data kept in memory would be lost when the new process starts
+var ErrUpgradeMemoryStore = errors.New("unable to upgrade while using an in-memory store, data would be lost")
+
+type UpgradeState struct {
+	Listeners map[string]uintptr
+	Channels  []*UpgradeChannel
+	Clients   []*UpgradeClient
+}
+
+type UpgradeChannel struct {
+	Identifier  string
+	Created     int64
+	Modes       map[string]string
+	Topic       string
+	TopicTime   int64
+	Logs        []*ChannelLog
+	LogSequence int64
+	Clients     map[string]int
+}
+
+type UpgradeClient struct {
+	FD uintptr
+
+	Identifier   string
+	Created      int64
+	Modes        map[string]string
+	IPHash       string
+	Nick         string
+	User         string
+	Host         string
+	Account      int64
+	Capabilities []string
+	CapVersion   int
+	Welcomed     bool
+	Limited      string
+	Buffered     string
+
+	// Clients may be upgraded while negotiating capabilities or authenticating
+	Negotiating   bool
+	SASLMechanism string
+	SASLBuffer    string
+}
+
+func (s *Server) upgradeInProgress() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.upgradewait != nil
+}
+
+// Block while an upgrade is in progress, returning true when the upgrade was aborted and the client should resume
+func (s *Server) waitUpgrade(c *Client) bool {
+	s.RLock()
+	wait := s.upgradewait
+	paused := s.upgradepaused
+	s.RUnlock()
+
+	if wait == nil {
+		return false
+	}
+
+	select {
+	case paused <- c:
+	case <-wait:
+		return true
+	}
+
+	<-wait
+	return true
+}
+
+// Serialize server state and replace the running process with a new binary, passing listening and client sockets to it.
+// Only plain TCP clients are transferred, TLS and WebSocket clients are disconnected and must reconnect.
+func (s *Server) upgrade() error {
+	if _, memory := s.store.(*MemoryStore); memory {
+		return ErrUpgradeMemoryStore
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "failed to locate executable")
+	}
+
+	s.Lock()
+	if s.upgradewait != nil {
+		s.Unlock()
+		return errors.New("an upgrade is already in progress")
+	}
+	s.upgradewait = make(chan struct{})
+	s.upgradepaused = make(chan *Client)
+
+	listeners := s.listeners
+	s.listeners = make(map[string]*Listener)
+	s.Unlock()
+
+	state := &UpgradeState{Listeners: make(map[string]uintptr)}
+	var files []*os.File
+
+	abort := func(err error) error {
+		for _, f := range files {
+			f.Close()
+		}
+
+		s.Lock()
+		close(s.upgradewait)
+		s.upgradewait = nil
+		s.upgradepaused = nil
+		s.Unlock()
+
+		s.updateListeners()
+		return err
+	}
+
+	// Stop accepting connections, pending connections will be accepted by the new process
+	for address, l := range listeners {
+		f, err := l.file()
+		if err != nil {
+			log.Printf("Failed to transfer listener %s: %v", l.config, err)
+		} else if f != nil {
+			files = append(files, f)
+			state.Listeners[address] = f.Fd()
+		}
+
+		l.Stop()
+	}
+
+	// Stop reading from clients
+	clients := s.getClients("")
+	for _, cl := range clients {
+		cl.conn.SetReadDeadline(time.Now())
+	}
+
+	paused := make(map[string]*Client)
+	timeout := time.After(UPGRADE_TIMEOUT)
+pause:
+	for len(paused) < len(clients) {
+		select {
+		case cl := <-s.upgradepaused:
+			paused[cl.identifier] = cl
+		case <-timeout:
+			break pause
+		}
+	}
+
+	for _, cl := range paused {
+		if _, ok := cl.conn.(*net.TCPConn); !ok {
+			// TLS and WebSocket sessions can't be transferred
+			cl.write(nil, irc.ERROR, []string{"Server is upgrading, please reconnect"})
+		}
+	}
+
+	for _, cl := range paused {
+		cl.conn.SetWriteDeadline(time.Now().Add(UPGRADE_TIMEOUT))
+		cl.wg.Wait()
+		cl.conn.SetWriteDeadline(time.Time{})
+
+		tcpconn, ok := cl.conn.(*net.TCPConn)
+		if !ok {
+			continue
+		}
+
+		f, err := tcpconn.File()
+		if err != nil {
+			log.Printf("Failed to transfer client %s: %v", cl.identifier, err)
+			continue
+		}
+		files = append(files, f)
+
+		uc := upgradeClient(cl)
+		uc.FD = f.Fd()
+		state.Clients = append(state.Clients, uc)
+	}
+
+	for _, ch := range s.getChannels("") {
+		ch.RLock()
+		uc := &UpgradeChannel{
+			Identifier:  ch.identifier,
+			Created:     ch.created,
+			Modes:       ch.getModes(),
+			Topic:       ch.topic,
+			TopicTime:   ch.topictime,
+			Logs:        ch.logs.Entries(),
+			LogSequence: ch.logs.sequence,
+			Clients:     make(map[string]int)}
+		ch.RUnlock()
+
+		ch.clients.Range(func(k, v interface{}) bool {
+			if _, ok := paused[k.(string)]; ok {
+				uc.Clients[k.(string)] = v.(int)
+			}
+			return true
+		})
+
+		state.Channels = append(state.Channels, uc)
+	}
+
+	statefile, err := ioutil.TempFile("", "anonircd-upgrade")
+	if err != nil {
+		return abort(errors.Wrap(err, "failed to create state file"))
+	}
+	defer os.Remove(statefile.Name())
+
+	err = json.NewEncoder(statefile).Encode(state)
+	statefile.Close()
+	if err != nil {
+		return abort(errors.Wrap(err, "failed to write state file"))
+	}
+
+	err = s.store.Close()
+	if err != nil {
+		return abort(err)
+	}
+
+	log.Printf("Upgrading to %s", executable)
+	err = execUpgrade(executable, files, append(os.Environ(), UPGRADE_ENV+"="+statefile.Name()))
+
+	// Exec only returns on failure
+	cerr := s.connectDatabase()
+	if cerr != nil {
+		log.Panicf("%+v", errors.Wrap(cerr, "failed to reconnect to database"))
+	}
+	return abort(errors.Wrap(err, "failed to execute new binary"))
+}
+
+// Restore server state passed by the process which was upgraded
+func (s *Server) resume(statefile string) error {
+	data, err := ioutil.ReadFile(statefile)
+	os.Remove(statefile)
+	if err != nil {
+		return errors.Wrap(err, "failed to read state file")
+	}
+
+	state := &UpgradeState{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse state file")
+	}
+
+	s.Lock()
+	for address, fd := range state.Listeners {
+		f := os.NewFile(fd, address)
+		listen, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Printf("Failed to resume listener %s: %v", address, err)
+			continue
+		}
+
+		s.inherited[address] = listen
+	}
+	s.Unlock()
+
+	for _, uc := range state.Channels {
+		ch := NewChannel(uc.Identifier)
+		ch.created = uc.Created
+		for mode, value := range uc.Modes {
+			ch.modes.Store(mode, value)
+		}
+		ch.topic = uc.Topic
+		ch.topictime = uc.TopicTime
+		s.setLogLimits(ch)
+		ch.logs.Restore(uc.Logs, uc.LogSequence)
+		for client, ccount := range uc.Clients {
+			ch.clients.Store(client, ccount)
+		}
+
+		s.channels.Store(foldChannel(ch.identifier), ch)
+	}
+
+	for _, ucl := range state.Clients {
+		f := os.NewFile(ucl.FD, ucl.Identifier)
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			log.Printf("Failed to resume client %s: %v", ucl.Identifier, err)
+			continue
+		}
+
+		s.resumeClient(ucl, conn)
+	}
+
+	// Remove clients which could not be resumed
+	for _, ch := range s.getChannels("") {
+		ch.clients.Range(func(k, v interface{}) bool {
+			if s.getClient(k.(string)) == nil {
+				ch.clients.Delete(k)
+			}
+			return true
+		})
+
+		s.scheduleReap(ch)
+	}
+
+	log.Printf("Resumed %d clients in %d channels", len(state.Clients), len(state.Channels))
+	return nil
+}
+
+// Serialize the state of a paused client
+func upgradeClient(cl *Client) *UpgradeClient {
+	limited := ""
+	if cl.limited != nil {
+		limited = cl.limited.Error()
+	}
+
+	buffered, _ := cl.reader.Peek(cl.reader.Buffered())
+	return &UpgradeClient{
+		Identifier:    cl.identifier,
+		Created:       cl.created,
+		Modes:         cl.getModes(),
+		IPHash:        cl.iphash,
+		Nick:          cl.nick,
+		User:          cl.user,
+		Host:          cl.host,
+		Account:       cl.account,
+		Capabilities:  cl.getCapabilities(),
+		CapVersion:    cl.capVersion,
+		Welcomed:      cl.welcomed,
+		Limited:       limited,
+		Buffered:      cl.partial + string(buffered),
+		Negotiating:   cl.negotiating,
+		SASLMechanism: cl.saslMechanism,
+		SASLBuffer:    cl.saslBuffer}
+}
+
+// Restore a client using its transferred connection and resume serving it
+func (s *Server) resumeClient(ucl *UpgradeClient, conn net.Conn) {
+	c := NewClient(ucl.Identifier, conn, false, s.store)
+	if c == nil {
+		conn.Close()
+		return
+	}
+	c.created = ucl.Created
+	for mode, value := range ucl.Modes {
+		c.modes.Store(mode, value)
+	}
+	c.iphash = ucl.IPHash
+	c.nick = ucl.Nick
+	c.user = ucl.User
+	c.host = ucl.Host
+	c.account = ucl.Account
+	for _, capability := range ucl.Capabilities {
+		c.enableCapability(capability)
+	}
+	c.capVersion = ucl.CapVersion
+	c.welcomed = ucl.Welcomed
+	c.negotiating = ucl.Negotiating
+	c.saslMechanism = ucl.SASLMechanism
+	c.saslBuffer = ucl.SASLBuffer
+	c.reader = bufio.NewReaderSize(io.MultiReader(strings.NewReader(ucl.Buffered), conn), CLIENT_READ_BUFFER)
+
+	if ucl.Limited != "" {
+		c.limited = errors.New(ucl.Limited)
+	} else {
+		s.connections.add(c.iphash)
+	}
+
+	s.clients.Store(c.identifier, c)
+	go func() {
+		s.serveClient(c)
+		if c.limited == nil {
+			s.connections.disconnect(c.iphash)
+		}
+	}()
+}
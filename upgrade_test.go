@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgradeResume(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c := newTestClient(t, conn)
+	defer c.Close()
+
+	serverconn, err := l.Accept()
+	require.NoError(t, err)
+
+	// Paused while negotiating capabilities and authenticating
+	s := newTestServer(t)
+	cl := NewClient("resumed", serverconn, false, s.store)
+	cl.nick = "test"
+	cl.user = "test"
+	cl.host = "*"
+	cl.capVersion = 302
+	cl.enableCapability(CAP_SASL)
+	cl.negotiating = true
+	cl.saslMechanism = SASL_PLAIN
+
+	// Some of the payload was received before pausing, the rest is still buffered
+	payload := base64.StdEncoding.EncodeToString([]byte("\x00admin\x00password"))
+	cl.saslBuffer = payload[:8]
+	c.send("AUTHENTICATE " + payload[8:])
+	cl.reader.Peek(1)
+
+	data, err := json.Marshal(upgradeClient(cl))
+	require.NoError(t, err)
+
+	ucl := &UpgradeClient{}
+	require.NoError(t, json.Unmarshal(data, ucl))
+	assert.True(t, ucl.Negotiating)
+	assert.Equal(t, SASL_PLAIN, ucl.SASLMechanism)
+
+	s = newTestServer(t)
+	s.resumeClient(ucl, serverconn)
+	resumed := s.getClient("resumed")
+	require.NotNil(t, resumed)
+
+	c.expect(" 900 test test!test@* admin ")
+	c.expect(" 903 ")
+
+	// Clients are not welcomed until negotiation ends
+	c.send("PING :negotiating")
+	c.expect("PONG AnonIRC negotiating")
+	c.send("CAP END")
+	c.expect(" 001 test ")
+}
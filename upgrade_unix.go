@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Replace the running process, passing the supplied files to it
+func execUpgrade(executable string, files []*os.File, env []string) error {
+	for _, f := range files {
+		// Clear close-on-exec flag
+		_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETFD, 0)
+		if errno != 0 {
+			return errno
+		}
+	}
+
+	return syscall.Exec(executable, os.Args, env)
+}
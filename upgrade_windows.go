@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func execUpgrade(executable string, files []*os.File, env []string) error {
+	return errors.New("upgrading is not supported on Windows")
+}
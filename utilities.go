@@ -20,12 +20,6 @@ type Pair struct {
 
 type PairList []Pair
 
-type int64arr []int64
-
-func (a int64arr) Len() int           { return len(a) }
-func (a int64arr) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a int64arr) Less(i, j int) bool { return a[i] < a[j] }
-
 func (p PairList) Len() int {
 	return len(p)
 }
@@ -55,6 +49,21 @@ func randomIdentifier() string {
 	return string(b)
 }
 
+// Fold a channel name according to the ascii CASEMAPPING advertised via RPL_ISUPPORT
+func foldChannel(channel string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + ('a' - 'A')
+		}
+		return r
+	}, channel)
+}
+
+// Hash of a case-folded channel name, as stored in the database
+func channelHash(channel string) string {
+	return generateHash(foldChannel(channel))
+}
+
 func generateHash(s string) string {
 	sha512 := sha3.New512()
 	_, err := sha512.Write([]byte(strings.Join([]string{s, fmt.Sprintf("%x", md5.Sum([]byte(s))), s}, "-")))
@@ -74,6 +83,20 @@ func containsString(s []string, e string) bool {
 	return false
 }
 
+// Usernames are limited to alphanumeric characters
+func validUsername(username string) bool {
+	if len(username) == 0 || len(username) > MAX_USERNAME_LENGTH {
+		return false
+	}
+
+	for _, r := range username {
+		if !(r >= 'a' && r <= 'z') && !(r >= 'A' && r <= 'Z') && !(r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
 // Problem
 func p(err error) bool {
 	return err != nil && err != sql.ErrNoRows
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// IRCv3 WebSocket subprotocols
+const (
+	WEBSOCKET_BINARY = "binary.ircv3.net"
+	WEBSOCKET_TEXT   = "text.ircv3.net"
+)
+
+// WebSocketConn adapts a WebSocket connection to net.Conn, with each WebSocket message carrying a single IRC line
+type WebSocketConn struct {
+	*websocket.Conn
+
+	messagetype int
+
+	reader      io.Reader
+	writebuffer bytes.Buffer
+	writelock   sync.Mutex
+}
+
+func NewWebSocketConn(ws *websocket.Conn) *WebSocketConn {
+	wc := &WebSocketConn{Conn: ws}
+
+	wc.messagetype = websocket.TextMessage
+	if ws.Subprotocol() == WEBSOCKET_BINARY {
+		wc.messagetype = websocket.BinaryMessage
+	}
+
+	return wc
+}
+
+func (wc *WebSocketConn) Read(p []byte) (int, error) {
+	for {
+		if wc.reader != nil {
+			n, err := wc.reader.Read(p)
+			if err == io.EOF {
+				wc.reader = nil
+				if n > 0 {
+					return n, nil
+				}
+				continue
+			}
+			return n, err
+		}
+
+		_, message, err := wc.Conn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+
+		// Messages are not terminated by CR LF, add a line ending for the decoder
+		message = append(bytes.TrimRight(message, "\r\n"), '\n')
+		wc.reader = bytes.NewReader(message)
+	}
+}
+
+func (wc *WebSocketConn) Write(p []byte) (int, error) {
+	wc.writelock.Lock()
+	defer wc.writelock.Unlock()
+
+	wc.writebuffer.Write(p)
+	for {
+		line, err := wc.writebuffer.ReadBytes('\n')
+		if err != nil {
+			// Incomplete line, wait for the remainder
+			wc.writebuffer.Reset()
+			wc.writebuffer.Write(line)
+			return len(p), nil
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+		if wc.messagetype == websocket.TextMessage && !utf8.Valid(line) {
+			// Replace invalid byte sequences with the Unicode replacement character
+			line = []byte(string([]rune(string(line))))
+		}
+
+		err = wc.Conn.WriteMessage(wc.messagetype, line)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (wc *WebSocketConn) SetDeadline(t time.Time) error {
+	return wc.Conn.UnderlyingConn().SetDeadline(t)
+}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request, ssl bool) {
+	upgrader := websocket.Upgrader{Subprotocols: []string{WEBSOCKET_TEXT, WEBSOCKET_BINARY}}
+	if len(s.config.WebSocketOrigins) > 0 {
+		upgrader.CheckOrigin = func(r *http.Request) bool {
+			return containsString(s.config.WebSocketOrigins, r.Header.Get("Origin"))
+		}
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrader has already responded with an error
+	}
+
+	s.handleConnection(NewWebSocketConn(ws), ssl)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Serve WebSocket connections to the server, returning the URL of the endpoint
+func serveTestWebSocket(t *testing.T, s *Server) (string, func()) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.handleWebSocket(w, r, false)
+	}))
+
+	return "ws" + strings.TrimPrefix(ts.URL, "http"), ts.Close
+}
+
+// Connect via WebSocket using the specified subprotocol and origin, the origin is not sent when empty
+func dialTestWebSocket(t *testing.T, url string, subprotocol string, origin string) (*websocket.Conn, *http.Response, error) {
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocol}}
+	return dialer.Dial(url, header)
+}
+
+func TestWebSocket(t *testing.T) {
+	s := newTestServer(t)
+	url, cleanup := serveTestWebSocket(t, s)
+	defer cleanup()
+
+	ws, _, err := dialTestWebSocket(t, url, WEBSOCKET_TEXT, "")
+	require.NoError(t, err)
+	defer ws.Close()
+	assert.Equal(t, WEBSOCKET_TEXT, ws.Subprotocol())
+
+	// Each message carries a single line without a line ending
+	require.NoError(t, ws.WriteMessage(websocket.TextMessage, []byte("NICK test")))
+	require.NoError(t, ws.WriteMessage(websocket.TextMessage, []byte("USER test 0 * :test\r\n")))
+
+	messagetype, message, err := ws.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.TextMessage, messagetype)
+	assert.Equal(t, ":AnonIRC 001 test :Welcome to AnonIRC test!test@*", string(message))
+
+	binary, _, err := dialTestWebSocket(t, url, WEBSOCKET_BINARY, "")
+	require.NoError(t, err)
+	defer binary.Close()
+
+	require.NoError(t, binary.WriteMessage(websocket.BinaryMessage, []byte("PING :binary")))
+	messagetype, message, err = binary.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, messagetype)
+	assert.Equal(t, ":AnonIRC PONG AnonIRC binary", string(message))
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	s := newTestServer(t)
+	url, cleanup := serveTestWebSocket(t, s)
+	defer cleanup()
+
+	// Connections from other origins are rejected unless allowed
+	_, resp, err := dialTestWebSocket(t, url, WEBSOCKET_TEXT, "https://example.com")
+	require.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	ws, _, err := dialTestWebSocket(t, url, WEBSOCKET_TEXT, "http://"+strings.TrimPrefix(url, "ws://"))
+	require.NoError(t, err)
+	ws.Close()
+
+	s.config.WebSocketOrigins = []string{"https://example.com"}
+	ws, _, err = dialTestWebSocket(t, url, WEBSOCKET_TEXT, "https://example.com")
+	require.NoError(t, err)
+	ws.Close()
+
+	_, resp, err = dialTestWebSocket(t, url, WEBSOCKET_TEXT, "https://example.org")
+	require.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestWebSocketThrottle(t *testing.T) {
+	s := newTestServer(t)
+	s.config.FloodCommandRate = 5
+	s.config.FloodCommandBurst = 1
+	url, cleanup := serveTestWebSocket(t, s)
+	defer cleanup()
+
+	ws, _, err := dialTestWebSocket(t, url, WEBSOCKET_TEXT, "")
+	require.NoError(t, err)
+	defer ws.Close()
+
+	c := newTestClient(t, NewWebSocketConn(ws))
+	c.send("NICK test", "USER test 0 * :test")
+	c.expect(" 001 ")
+
+	// Delayed clients remain connected
+	start := time.Now()
+	c.send("INFO", "INFO", "INFO")
+	for i := 0; i < 3; i++ {
+		c.expect("PRIVMSG test :AnonIRCd")
+	}
+	assert.True(t, time.Since(start) >= 350*time.Millisecond, "commands were not delayed")
+
+	c.send("PING :connected")
+	c.expect("PONG AnonIRC connected")
+}